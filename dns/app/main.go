@@ -1,244 +1,285 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/alexflint/go-arg"
+	"github.com/codecrafters-io/dns-server-starter-go/dns"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var args struct {
-	Resolver string
+	Resolver         []string             `arg:"--resolver,separate" help:"address of resolver to forward queries to, can be repeated - without it every query gets local answer"`
+	UpstreamStrategy dns.UpstreamStrategy `arg:"--upstream-strategy" default:"failover" help:"order in which resolvers are asked: failover, round-robin, random, fastest (lowest smoothed RTT) or race (the fastest ones at the same time)"`
+	Forward          []string             `arg:"--forward,separate" help:"suffix=address - names under suffix are forwarded to that resolver instead of --resolver, can be repeated (longest suffix wins)"`
+	UpstreamRacers   int                  `arg:"--upstream-racers" default:"2" help:"how many resolvers are asked at the same time with race strategy"`
+	Zone             []string             `arg:"--zone,separate" help:"zone file in RFC 1035 master format to answer authoritatively from, can be repeated - other names are forwarded to --resolver or REFUSED without it"`
+	Listen           []string             `arg:"--listen,separate" help:"address to listen on, can be repeated - host:port for UDP and TCP or udp://host:port, tcp6://host:port ... for one network only [default: 127.0.0.1:2053]"`
+	MaxInFlight      int                  `arg:"--max-in-flight" default:"100" help:"how many queries can be handled at the same time on each UDP socket"`
+	UpstreamAttempts int                  `arg:"--upstream-attempts" default:"3" help:"how many times query is sent to resolver before giving up with SERVFAIL"`
+	UpstreamTimeout  time.Duration        `arg:"--upstream-timeout" default:"1s" help:"how long to wait for the first attempt, every next one waits twice as long"`
+	TCPConnections   int                  `arg:"--tcp-connections" default:"100" help:"how many TCP connections can be open at the same time on each TCP socket"`
+	TCPIdleTimeout   time.Duration        `arg:"--tcp-idle-timeout" default:"10s" help:"TCP connection without new queries for that long is closed"`
+	CacheSize        int                  `arg:"--cache-size" default:"10000" help:"how many answers from resolver are cached, 0 disables the cache"`
+	CacheMaxStale    time.Duration        `arg:"--cache-max-stale" default:"1h" help:"how long after expiry cached answer is still served when resolver fails, 0 disables it"`
+	ShutdownTimeout  time.Duration        `arg:"--shutdown-timeout" default:"5s" help:"how long to wait for queries in progress to get their answers after SIGINT or SIGTERM"`
 }
 
-// TODO: use go channells and support multiple callers?
+const (
+	exitOK = 0
+	// server failed to start, stopped on its own or queries in progress didn't get answers before shutdown timeout
+	exitFailure = 1
+)
+
 // TODO: Simulating retry logic by using toxiproxy: - https://github.com/Shopify/toxiproxy - this will require docker setup ideally
 func main() {
-	var udpConnResolver net.Conn
-	var err error
+	status := run()
+
+	// os.Exit skips defers so everything that needs cleaning up is done in run
+	// stdout is synced so the last log lines are not lost when it's redirected to a file
+	_ = os.Stdout.Sync()
+	os.Exit(status)
+}
 
+// Runs the server until SIGINT or SIGTERM and returns exit status
+// on signal server stops reading new queries and waits up to shutdown-timeout for the ones in progress
+// second signal while waiting kills the process right away
+func run() int {
 	arg.MustParse(&args)
 
-	if args.Resolver != "" {
-		fmt.Println("Server configured to proxy to address: ", args.Resolver)
+	if args.MaxInFlight < 1 {
+		log.Fatal("max-in-flight has to be at least 1 got: ", args.MaxInFlight)
+	}
 
-		udpConnResolver, err = net.Dial("udp", args.Resolver)
+	if args.UpstreamAttempts < 1 || args.UpstreamTimeout <= 0 {
+		log.Fatal("upstream-attempts has to be at least 1 and upstream-timeout has to be positive")
+	}
 
-		defer func(conn net.Conn) {
-			err := conn.Close()
-			if err != nil {
-				fmt.Println("Failed to close connection", err)
-				// this usually will happen when file is already closed so no need to retry
-			}
-		}(udpConnResolver)
+	if args.TCPConnections < 1 || args.TCPIdleTimeout <= 0 {
+		log.Fatal("tcp-connections has to be at least 1 and tcp-idle-timeout has to be positive")
+	}
 
-		if err != nil {
-			log.Fatal("failed to dial resolver: ", err)
-		}
+	if args.UpstreamRacers < 1 {
+		log.Fatal("upstream-racers has to be at least 1 got: ", args.UpstreamRacers)
+	}
 
-		fmt.Println("Dial to resolver successful:  ", args.Resolver)
+	if args.CacheSize < 0 {
+		log.Fatal("cache-size can't be negative got: ", args.CacheSize)
 	}
 
-	fmt.Println("Server configured to listen: ", "127.0.0.1:2053")
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		log.Fatal("failed to resolve UDP address: ", err)
+	if args.CacheMaxStale < 0 {
+		log.Fatal("cache-max-stale can't be negative got: ", args.CacheMaxStale)
 	}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		log.Fatal("failed to bind to address: ", err)
+	if args.ShutdownTimeout <= 0 {
+		log.Fatal("shutdown-timeout has to be positive got: ", args.ShutdownTimeout)
 	}
 
-	defer func(udpConn *net.UDPConn) {
-		err := udpConn.Close()
-		if err != nil {
-			fmt.Println("Failed to close udp connection", err)
-			// this usually will happen when file is already closed so no need to retry
-		}
-	}(udpConn)
+	forwardRules, err := parseForwardRules(args.Forward)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(forwardRules) > 0 && len(args.Resolver) == 0 {
+		log.Fatal("forward needs resolver for names without forwarding rule")
+	}
 
-	buf := make([]byte, 512)
+	// without resolver we answer locally
+	var handler dns.Handler = dns.LocalHandler{}
+	var forwarding *dns.ForwardingHandler
+
+	if len(args.Resolver) > 0 {
+		fmt.Println("Server configured to proxy to addresses: ", args.Resolver, "strategy:", args.UpstreamStrategy)
+
+		var upstreams []*dns.Upstream
+		// closed only after shutdown so queries that are being drained can still reach the resolver
+		defer func() {
+			for _, upstream := range upstreams {
+				err := upstream.Close()
+				if err != nil {
+					fmt.Println("Failed to close connection", err)
+					// this usually will happen when file is already closed so no need to retry
+				}
+			}
+		}()
+
+		// every pool gets its own upstreams - all of them are closed on exit
+		newPool := func(addresses []string) (*dns.UpstreamPool, error) {
+			var members []*dns.Upstream
+			for _, address := range addresses {
+				upstream, err := dialUpstream(address)
+				if err != nil {
+					return nil, err
+				}
+				upstreams = append(upstreams, upstream)
+				members = append(members, upstream)
+				fmt.Println("Dial to resolver successful:  ", address)
+			}
 
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
-		if err != nil {
-			fmt.Println("Error receiving data:", err)
-			break
+			pool := dns.NewUpstreamPool(args.UpstreamStrategy, members...)
+			pool.Racers = args.UpstreamRacers
+			return pool, nil
 		}
 
-		fmt.Printf("Received %d bytes from %s\n", size, source)
-
-		receivedMessage := DNSMessage{}
-		err = receivedMessage.Decode(buf[:size])
+		fallback, err := newPool(args.Resolver)
 		if err != nil {
-			fmt.Printf("Couldn't decode message: %e", err)
-			continue
-		}
-
-		var questions []DNSQuestion
-		var answers []DNSAnswer
-
-		for _, questionReceived := range receivedMessage.Questions {
-			questions = append(questions, DNSQuestion{
-				Name:  questionReceived.Name,
-				Class: 1,
-				Type:  1,
-			})
+			log.Println("failed to dial resolver: ", err)
+			return exitFailure
 		}
 
-		if udpConnResolver != nil {
-			answers, err = contactResolver(receivedMessage, udpConnResolver)
+		// names without forwarding rule go to --resolver
+		split := dns.NewSplitResolver(fallback)
+		for _, rule := range forwardRules {
+			fmt.Println("Forwarding names under", rule.suffix, "to: ", rule.addresses)
+			pool, err := newPool(rule.addresses)
 			if err != nil {
-				fmt.Printf("Error when contacting resolver: %e\n", err)
+				log.Println("failed to dial resolver: ", err)
+				return exitFailure
 			}
-		} else {
-			answers, err = generateLocalResponse(receivedMessage)
+			err = split.Route(rule.suffix, pool)
 			if err != nil {
-				fmt.Printf("Error when reaching local dns cache: %e\n", err)
+				log.Println("invalid forwarding rule: ", err)
+				return exitFailure
 			}
 		}
-		response, err := generateReponse(receivedMessage, questions, answers)
-		if err != nil {
-			fmt.Printf("Error when generating response: %e\n", err)
-		}
 
-		_, err = udpConn.WriteToUDP(response, source)
-		if err != nil {
-			fmt.Printf("Failed to send response: %e\n", err)
+		forwarding = dns.NewForwardingHandler(split)
+		if args.CacheSize > 0 {
+			forwarding.Cache = dns.NewCache(args.CacheSize)
+			forwarding.Cache.MaxStale = args.CacheMaxStale
 		}
+		handler = forwarding
 	}
-}
 
-func contactResolver(receivedMessage DNSMessage, udpConnResolver net.Conn) ([]DNSAnswer, error) {
-	var answers []DNSAnswer
-	for _, questionReceived := range receivedMessage.Questions {
-		newMessageToResolver := DNSMessage{
-			Header:    receivedMessage.Header,
-			Questions: []DNSQuestion{questionReceived},
+	if len(args.Zone) > 0 {
+		var zones []*dns.Zone
+		for _, path := range args.Zone {
+			zone, err := dns.LoadZoneFile(path)
+			if err != nil {
+				log.Println("failed to load zone: ", err)
+				return exitFailure
+			}
+			fmt.Println("Serving zone", zone.Origin(), "from", path)
+			zones = append(zones, zone)
 		}
 
-		// We can only send one question at a time to resolver
-		// Actually apparently this feature to sent multiple questions in one DNS query is not really used
-		newMessageToResolver.Header.QDCOUNT = 1
-
-		forwardedMessage, err := newMessageToResolver.Encode()
+		zoneHandler, err := dns.NewZoneHandler(zones...)
 		if err != nil {
-			return nil, fmt.Errorf("failed to encode query to resolver: %e", err)
+			log.Println(err)
+			return exitFailure
 		}
-
-		fmt.Println("Sending message to resolver:  ", args.Resolver)
-		_, err = udpConnResolver.Write(forwardedMessage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to send message to resolver: %e", err)
+		// names outside our zones are REFUSED unless there is resolver to ask
+		if forwarding != nil {
+			zoneHandler.Fallback = forwarding
 		}
+		handler = zoneHandler
+	}
 
-		buf := make([]byte, 512)
+	server := &dns.Server{
+		Addrs:          args.Listen,
+		Handler:        handler,
+		MaxInFlight:    args.MaxInFlight,
+		TCPConnections: args.TCPConnections,
+		TCPIdleTimeout: args.TCPIdleTimeout,
+	}
 
-		sizeRes, err := udpConnResolver.Read(buf)
-		if err != nil {
-			fmt.Println("error receiving data:", err)
-
-			retries := 0
-			success := false
-			maxRetries := 5
-			retryDelay := time.Duration(1000)
-			for retries < maxRetries {
-				fmt.Println("retrying the call to resolver: ", err)
-				time.Sleep(retryDelay)
-				sizeRes, err = udpConnResolver.Read(buf)
-				if err == nil {
-					fmt.Println("retrying successful: ", err)
-					success = true
-					break
-				}
-				retries++
-			}
-			if !success {
-				fmt.Println("failed to receive data after retries:", err)
-				break
-			}
+	err = server.Listen()
+	if err != nil {
+		log.Println(err)
+		return exitFailure
+	}
 
-			break
-		}
+	for _, addr := range server.LocalAddrs() {
+		fmt.Println("Server configured to listen: ", addr.Network(), addr)
+	}
 
-		fmt.Printf("Received %d bytes", sizeRes)
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		responseFromeResolver := DNSMessage{}
-		err = responseFromeResolver.Decode(buf[:sizeRes])
-		if err != nil {
-			return nil, fmt.Errorf("failure on decoding response from resolver: %e", err)
-		}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
 
-		for _, answerReceived := range responseFromeResolver.Answers {
-			answers = append(answers, answerReceived)
-		}
+	select {
+	case err := <-served:
+		// sockets stopped without anyone asking for it
+		log.Println("server stopped: ", err)
+		return exitFailure
+	case <-signals.Done():
 	}
-	return answers, nil
-}
 
-func generateReponse(receivedMessage DNSMessage, questions []DNSQuestion, answers []DNSAnswer) ([]byte, error) {
-	responseMessage := DNSMessage{
-		Header: DNSHeader{
-			ID:      receivedMessage.Header.ID,
-			QDCOUNT: uint16(len(receivedMessage.Questions)),
-			ANCOUNT: uint16(len(receivedMessage.Questions)),
-			NSCOUNT: 0, // TODO: Not supported
-			ARCOUNT: 0, // TODO Not Supported
-		},
-		Questions: questions,
-		Answers:   answers,
-	}
+	// from now on signals are handled the default way - second one kills the process
+	stop()
+	fmt.Println("Shutting down, waiting for queries in progress up to", args.ShutdownTimeout)
 
-	//TODO: hide the complexity of what QR means and just create a flag IS this response or query
-	responseMessage.Header.FLAGS.SetQR(true)
+	ctx, cancel := context.WithTimeout(context.Background(), args.ShutdownTimeout)
+	defer cancel()
 
-	err := responseMessage.Header.FLAGS.SetOpCode(receivedMessage.Header.FLAGS.GetOpCode())
+	status := exitOK
+	err = server.Shutdown(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set opcode: %e", err)
+		log.Println("shutdown failed: ", err)
+		status = exitFailure
 	}
 
-	responseMessage.Header.FLAGS.SetRD(receivedMessage.Header.FLAGS.GetRD())
-
-	if receivedMessage.Header.FLAGS.GetOpCode() == 0 {
-		err = responseMessage.Header.FLAGS.SetRcode(0)
-	} else {
-		//TODO: why in the task we should set rcode to 4?
-		err = responseMessage.Header.FLAGS.SetRcode(4)
+	err = <-served
+	if !errors.Is(err, dns.ErrServerClosed) {
+		log.Println("server stopped: ", err)
+		status = exitFailure
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to set rcode: %e", err)
+	if forwarding != nil {
+		fmt.Println("Resolver stats:", forwarding.Stats())
 	}
+	fmt.Println("Server stopped")
+	return status
+}
 
-	response, err := responseMessage.Encode()
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode response: %e", err)
-	}
-	return response, nil
+// resolvers for names under suffix
+type forwardRule struct {
+	suffix    string
+	addresses []string
 }
 
-func generateLocalResponse(receivedMessage DNSMessage) ([]DNSAnswer, error) {
-	// This returns static message
-	var answers []DNSAnswer
+// parses suffix=address flags - rules for the same suffix are merged so it can have many resolvers
+func parseForwardRules(flags []string) ([]forwardRule, error) {
+	var rules []forwardRule
+	indexes := map[string]int{}
+	for _, flag := range flags {
+		suffix, address, ok := strings.Cut(flag, "=")
+		if !ok || suffix == "" || address == "" {
+			return nil, fmt.Errorf("invalid forward %q, expected suffix=address", flag)
+		}
 
-	ipEncoded, err := ipV4Encoder("8.8.8.8")
-	if err != nil {
-		fmt.Println("Couldnt encode answer data:", err)
+		suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+		i, ok := indexes[suffix]
+		if !ok {
+			i = len(rules)
+			indexes[suffix] = i
+			rules = append(rules, forwardRule{suffix: suffix})
+		}
+		rules[i].addresses = append(rules[i].addresses, address)
 	}
+	return rules, nil
+}
 
-	for _, questionReceived := range receivedMessage.Questions {
-		answers = append(answers, DNSAnswer{
-			Name:   questionReceived.Name,
-			Class:  1,
-			Type:   1,
-			TTL:    60,
-			Length: 4,
-			Data:   ipEncoded,
-		})
+func dialUpstream(address string) (*dns.Upstream, error) {
+	udpConnResolver, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
 	}
 
-	return answers, nil
+	// one socket is shared by all the queries - upstream client matches responses with queries
+	upstream := dns.NewUpstream(udpConnResolver)
+	upstream.Retry.Attempts = args.UpstreamAttempts
+	upstream.Retry.AttemptTimeout = args.UpstreamTimeout
+	upstream.Retry.MaxAttemptTimeout = max(upstream.Retry.MaxAttemptTimeout, args.UpstreamTimeout)
+	return upstream, nil
 }
@@ -0,0 +1,345 @@
+package dns
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// answers are never kept for longer than a day even if resolver says they can be
+	// so a mistake with a huge TTL doesn't stay with us forever
+	maxCacheTTL uint32 = 24 * 60 * 60
+	// name that doesn't exist now can be added any moment - https://www.rfc-editor.org/rfc/rfc2308#section-5
+	maxNegativeCacheTTL uint32 = 3 * 60 * 60
+	// stale answer is served with short TTL so clients come back soon for a fresh one
+	// https://www.rfc-editor.org/rfc/rfc8767#section-4
+	staleTTL uint32 = 30
+	// answer asked for at least that many times is refreshed in the background
+	// when less than 1/refreshBeforeFraction of its TTL is left - so popular names never expire
+	refreshHits           = 3
+	refreshBeforeFraction = 10
+)
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	// fresh but close to expiry and popular - caller should refresh it in the background
+	cacheRefresh
+)
+
+// answers are looked up the same way as queries are matched with responses - case insensitive name, type and class
+// DO and CD are part of the key as they are passed to resolver and change its answer
+// with DO it comes with DNSSEC signatures, with CD it's not validated - https://www.rfc-editor.org/rfc/rfc4035#section-4.5
+type cacheKey struct {
+	name  string
+	type_ uint16
+	class uint16
+	do    bool
+	cd    bool
+}
+
+// key for query with single question
+func newCacheKey(query DNSMessage) cacheKey {
+	question := query.Questions[0]
+	key := cacheKey{
+		name:  string(bytes.ToLower(question.Name)),
+		type_: question.Type,
+		class: question.Class,
+		cd:    query.Header.FLAGS.GetCD(),
+	}
+	// query with malformed OPT never gets here - server answers FORMERR
+	if opt, err := query.OPT(); err == nil && opt != nil {
+		key.do = opt.DO
+	}
+	return key
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// rcode and records of resolver response, without OPT as that one is hop by hop
+	response  DNSMessage
+	storedAt  time.Time
+	expiresAt time.Time
+	// how many times it was served - popular answers are refreshed before they expire
+	hits       int
+	refreshing bool
+}
+
+// Cache keeps resolver answers for single questions until the smallest TTL of their records runs out
+// names that don't exist and names without records of the asked type are kept as well (negative caching)
+// when it's full the least recently used answer is dropped to make room for the new one
+// TTLs of the records are decreased by the time spent in cache when they are served
+// so clients never keep them for longer than the resolver allowed
+//
+// expired answers are kept for MaxStale longer so they can be served when resolver fails - see GetStale
+type Cache struct {
+	capacity int
+	// how long after expiry answer can still be served when resolver fails, 0 disables serving stale answers
+	// can be changed only before the cache is used
+	MaxStale time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// most recently used at the front
+	lru *list.List
+	now func() time.Time
+}
+
+// NewCache creates cache holding answers for at most capacity questions
+func NewCache(capacity int) *Cache {
+	return &Cache{
+		capacity: capacity,
+		entries:  map[cacheKey]*list.Element{},
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get returns copy of the cached response with TTLs decreased by the time it was kept
+// query has to have exactly one question
+func (c *Cache) Get(query DNSMessage) (DNSMessage, bool) {
+	response, state := c.lookup(query)
+	return response, state != cacheMiss
+}
+
+// same as Get but tells when the answer should be refreshed in the background
+// only one caller is told to refresh it - the next ones get cacheFresh until the new answer is Set
+func (c *Cache) lookup(query DNSMessage) (DNSMessage, cacheState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, entry := c.entry(query)
+	if entry == nil {
+		return DNSMessage{}, cacheMiss
+	}
+
+	now := c.now()
+	if !now.Before(entry.expiresAt) {
+		// still there only to be served stale
+		return DNSMessage{}, cacheMiss
+	}
+
+	c.lru.MoveToFront(element)
+	entry.hits++
+	response := entry.responseAt(now)
+
+	left := entry.expiresAt.Sub(now)
+	if !entry.refreshing && entry.hits >= refreshHits && left*refreshBeforeFraction <= entry.expiresAt.Sub(entry.storedAt) {
+		entry.refreshing = true
+		return response, cacheRefresh
+	}
+	return response, cacheFresh
+}
+
+// GetStale returns the last answer for the query even if it expired less than MaxStale ago
+// meant for when resolver fails - expired records are served with 30s TTL
+// https://www.rfc-editor.org/rfc/rfc8767
+func (c *Cache) GetStale(query DNSMessage) (DNSMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, entry := c.entry(query)
+	if entry == nil {
+		return DNSMessage{}, false
+	}
+	if now := c.now(); now.Before(entry.expiresAt) {
+		return entry.responseAt(now), true
+	}
+
+	response := DNSMessage{Header: entry.response.Header}
+	response.Answers = recordsWithTTL(entry.response.Answers, staleTTL)
+	response.Authority = recordsWithTTL(entry.response.Authority, staleTTL)
+	response.Additional = recordsWithTTL(entry.response.Additional, staleTTL)
+	return response, true
+}
+
+// returns entry for the query unless it's too old even to be served stale - those are removed
+// has to be called with mu locked
+func (c *Cache) entry(query DNSMessage) (*list.Element, *cacheEntry) {
+	element, ok := c.entries[newCacheKey(query)]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt.Add(c.MaxStale)) {
+		c.remove(element)
+		return nil, nil
+	}
+	return element, entry
+}
+
+// copy of the response with TTLs decreased by the time it was kept
+func (e *cacheEntry) responseAt(now time.Time) DNSMessage {
+	elapsed := uint32(now.Sub(e.storedAt) / time.Second)
+	response := DNSMessage{Header: e.response.Header}
+	response.Answers = recordsWithDecreasedTTL(e.response.Answers, elapsed)
+	response.Authority = recordsWithDecreasedTTL(e.response.Authority, elapsed)
+	response.Additional = recordsWithDecreasedTTL(e.response.Additional, elapsed)
+	return response
+}
+
+// Set stores resolver response for the query (with single question) if it can be cached
+//   - successful answers with at least one record
+//   - negative answers (NXDOMAIN or NODATA) with SOA in authority - https://www.rfc-editor.org/rfc/rfc2308
+//
+// truncated responses are not cached - they are not the full answer
+// and neither are answers with TTL 0 as they are meant to be used only once
+func (c *Cache) Set(query DNSMessage, response DNSMessage) {
+	if response.Header.FLAGS.GetTC() {
+		return
+	}
+
+	stored := DNSMessage{
+		Answers:    cappedRecords(response.Answers),
+		Authority:  cappedRecords(response.Authority),
+		Additional: cappedRecords(withoutOPT(response.Additional)),
+	}
+	// only rcode is needed from the header
+	_ = stored.Header.FLAGS.SetRcode(response.Header.FLAGS.GetRcode())
+
+	if isNegativeResponse(response) {
+		if !setNegativeTTL(stored.Authority) {
+			// without SOA there is no way to tell how long the name doesn't exist
+			return
+		}
+	} else if response.Header.FLAGS.GetRcode() != RcodeSuccess || len(response.Answers) == 0 {
+		// failures and referrals - the previous answer is kept so it can still be served stale
+		return
+	}
+
+	ttl := minTTL(stored)
+	if ttl == 0 {
+		return
+	}
+
+	now := c.now()
+	entry := &cacheEntry{
+		key:       newCacheKey(query),
+		response:  stored,
+		storedAt:  now,
+		expiresAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns number of cached answers including the expired ones kept to be served stale
+// and the ones that expired completely but were not looked up since
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+func minTTL(message DNSMessage) uint32 {
+	ttl := maxCacheTTL
+	for _, section := range [][]DNSAnswer{message.Answers, message.Authority, message.Additional} {
+		for _, record := range section {
+			ttl = min(ttl, record.TTL)
+		}
+	}
+	return ttl
+}
+
+// NXDOMAIN - name doesn't exist, NODATA - name exists but doesn't have records of asked type
+// NODATA looks like a referral (NOERROR without answers) only it has SOA in authority instead of NS
+// https://www.rfc-editor.org/rfc/rfc2308#section-2
+func isNegativeResponse(response DNSMessage) bool {
+	switch response.Header.FLAGS.GetRcode() {
+	case RcodeNameError:
+		return true
+	case RcodeSuccess:
+		return len(response.Answers) == 0 && hasSOA(response.Authority)
+	}
+	return false
+}
+
+func hasSOA(records []DNSAnswer) bool {
+	for _, record := range records {
+		if record.Type == TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// negative answer is cached for the smaller of SOA TTL and SOA MINIMUM - https://www.rfc-editor.org/rfc/rfc2308#section-5
+// SOA TTL is set to that value so it's decreased together with the rest and served with the answer from cache
+// returns false when there is no usable SOA
+func setNegativeTTL(authority []DNSAnswer) bool {
+	for i, record := range authority {
+		if record.Type != TypeSOA {
+			continue
+		}
+		rdata, err := record.RData()
+		if err != nil {
+			return false
+		}
+		authority[i].TTL = min(record.TTL, rdata.(*RDataSOA).Minimum, maxNegativeCacheTTL)
+		return true
+	}
+	return false
+}
+
+// records are copied so TTL changes don't touch what the caller or the cache holds
+func cappedRecords(records []DNSAnswer) []DNSAnswer {
+	var capped []DNSAnswer
+	for _, record := range records {
+		record.TTL = min(record.TTL, maxCacheTTL)
+		capped = append(capped, record)
+	}
+	return capped
+}
+
+func recordsWithDecreasedTTL(records []DNSAnswer, elapsed uint32) []DNSAnswer {
+	var decreased []DNSAnswer
+	for _, record := range records {
+		// entry expires with its smallest TTL so this can only happen to records with exactly that TTL
+		if record.TTL > elapsed {
+			record.TTL -= elapsed
+		} else {
+			record.TTL = 0
+		}
+		decreased = append(decreased, record)
+	}
+	return decreased
+}
+
+func recordsWithTTL(records []DNSAnswer, ttl uint32) []DNSAnswer {
+	var changed []DNSAnswer
+	for _, record := range records {
+		record.TTL = min(record.TTL, ttl)
+		changed = append(changed, record)
+	}
+	return changed
+}
+
+func withoutOPT(records []DNSAnswer) []DNSAnswer {
+	var kept []DNSAnswer
+	for _, record := range records {
+		if record.Type != TypeOPT {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
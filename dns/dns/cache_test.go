@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cache with clock that moves only when the test says so
+func newTestCache(capacity int) (*Cache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewCache(capacity)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+// query for A record of the name as the handler sends it to resolver
+func newTestCacheQuery(name string) DNSMessage {
+	return DNSMessage{Questions: []DNSQuestion{{Name: EncodeName(name), Type: TypeA, Class: ClassIN}}}
+}
+
+func newTestCacheResponse(t *testing.T, name string, ttl uint32) DNSMessage {
+	answer, err := NewAnswer(name, ClassIN, ttl, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+	assert.NoError(t, err)
+	return DNSMessage{Answers: []DNSAnswer{answer}}
+}
+
+func TestCacheDecreasesTTL(t *testing.T) {
+	cache, now := newTestCache(10)
+	question := newTestCacheQuery("mfranc.com")
+
+	_, ok := cache.Get(question)
+	assert.False(t, ok)
+
+	response := newTestCacheResponse(t, "mfranc.com", 60)
+	ns, err := NewAnswer("mfranc.com", ClassIN, 300, &RDataNS{Host: "ns1.mfranc.com"})
+	assert.NoError(t, err)
+	response.Authority = []DNSAnswer{ns}
+	cache.Set(question, response)
+
+	*now = now.Add(20*time.Second + 500*time.Millisecond)
+	cached, ok := cache.Get(question)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(40), cached.Answers[0].TTL)
+	assert.Equal(t, uint32(280), cached.Authority[0].TTL)
+	assert.Equal(t, RcodeSuccess, cached.Header.FLAGS.GetRcode())
+
+	// what was served doesn't change what is cached
+	cached.Answers[0].TTL = 1
+	cached, ok = cache.Get(question)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(40), cached.Answers[0].TTL)
+	assert.Equal(t, uint32(60), response.Answers[0].TTL)
+}
+
+// the whole answer expires with the record with the smallest TTL
+func TestCacheExpires(t *testing.T) {
+	cache, now := newTestCache(10)
+	question := newTestCacheQuery("mfranc.com")
+
+	cache.Set(question, newTestCacheResponse(t, "mfranc.com", 60))
+
+	*now = now.Add(59 * time.Second)
+	_, ok := cache.Get(question)
+	assert.True(t, ok)
+
+	*now = now.Add(time.Second)
+	_, ok = cache.Get(question)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, _ := newTestCache(2)
+	first := newTestCacheQuery("first.mfranc.com")
+	second := newTestCacheQuery("second.mfranc.com")
+	third := newTestCacheQuery("third.mfranc.com")
+
+	cache.Set(first, newTestCacheResponse(t, "first.mfranc.com", 60))
+	cache.Set(second, newTestCacheResponse(t, "second.mfranc.com", 60))
+
+	// first is used so second is the least recently used one now
+	_, ok := cache.Get(first)
+	assert.True(t, ok)
+
+	cache.Set(third, newTestCacheResponse(t, "third.mfranc.com", 60))
+	assert.Equal(t, 2, cache.Len())
+
+	_, ok = cache.Get(second)
+	assert.False(t, ok)
+	_, ok = cache.Get(first)
+	assert.True(t, ok)
+	_, ok = cache.Get(third)
+	assert.True(t, ok)
+}
+
+func TestCacheKey(t *testing.T) {
+	cache, _ := newTestCache(10)
+	cache.Set(newTestCacheQuery("MFranc.com"), newTestCacheResponse(t, "MFranc.com", 60))
+
+	_, ok := cache.Get(newTestCacheQuery("mfranc.COM"))
+	assert.True(t, ok)
+
+	_, ok = cache.Get(DNSMessage{Questions: []DNSQuestion{{Name: EncodeName("mfranc.com"), Type: TypeAAAA, Class: ClassIN}}})
+	assert.False(t, ok)
+	_, ok = cache.Get(DNSMessage{Questions: []DNSQuestion{{Name: EncodeName("mfranc.com"), Type: TypeA, Class: ClassANY}}})
+	assert.False(t, ok)
+
+	// answer to the same question with DO or CD is a different one
+	withDO := newTestCacheQuery("mfranc.com")
+	assert.NoError(t, withDO.SetOPT(&OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize, DO: true}))
+	_, ok = cache.Get(withDO)
+	assert.False(t, ok)
+	withCD := newTestCacheQuery("mfranc.com")
+	withCD.Header.FLAGS.SetCD(true)
+	_, ok = cache.Get(withCD)
+	assert.False(t, ok)
+
+	// OPT without DO is the same as no OPT
+	withOPT := newTestCacheQuery("mfranc.com")
+	assert.NoError(t, withOPT.SetOPT(&OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize}))
+	_, ok = cache.Get(withOPT)
+	assert.True(t, ok)
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	cache, _ := newTestCache(10)
+	question := newTestCacheQuery("mfranc.com")
+
+	truncated := newTestCacheResponse(t, "mfranc.com", 60)
+	truncated.Header.FLAGS.SetTC(true)
+	cache.Set(question, truncated)
+
+	failed := newTestCacheResponse(t, "mfranc.com", 60)
+	err := failed.Header.FLAGS.SetRcode(RcodeServerFailure)
+	assert.NoError(t, err)
+	cache.Set(question, failed)
+
+	cache.Set(question, DNSMessage{})
+	cache.Set(question, newTestCacheResponse(t, "mfranc.com", 0))
+
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheDropsOPTAndCapsTTL(t *testing.T) {
+	cache, _ := newTestCache(10)
+	question := newTestCacheQuery("mfranc.com")
+
+	response := newTestCacheResponse(t, "mfranc.com", 7*24*60*60)
+	err := response.SetOPT(&OPTRecord{UDPPayloadSize: 1232})
+	assert.NoError(t, err)
+	cache.Set(question, response)
+
+	cached, ok := cache.Get(question)
+	assert.True(t, ok)
+	assert.Equal(t, maxCacheTTL, cached.Answers[0].TTL)
+	assert.Equal(t, 0, len(cached.Additional))
+}
+
+func newTestNegativeResponse(t *testing.T, rcode uint16, soaTTL uint32, minimum uint32) DNSMessage {
+	soa, err := NewAnswer("mfranc.com", ClassIN, soaTTL, &RDataSOA{MName: "ns1.mfranc.com", RName: "admin.mfranc.com", Minimum: minimum})
+	assert.NoError(t, err)
+
+	response := DNSMessage{Authority: []DNSAnswer{soa}}
+	err = response.Header.FLAGS.SetRcode(rcode)
+	assert.NoError(t, err)
+	return response
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       uint16
+		soaTTL      uint32
+		minimum     uint32
+		expectedTTL uint32
+	}{
+		{"nxdomain minimum smaller", RcodeNameError, 3600, 300, 300},
+		{"nxdomain soa ttl smaller", RcodeNameError, 60, 300, 60},
+		{"nodata", RcodeSuccess, 3600, 600, 600},
+		{"capped", RcodeNameError, 86400, 86400, maxNegativeCacheTTL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, now := newTestCache(10)
+			question := newTestCacheQuery("missing.mfranc.com")
+
+			cache.Set(question, newTestNegativeResponse(t, test.rcode, test.soaTTL, test.minimum))
+
+			// served with SOA in authority and its TTL decreased like any other
+			*now = now.Add(10 * time.Second)
+			cached, ok := cache.Get(question)
+			assert.True(t, ok)
+			assert.Equal(t, test.rcode, cached.Header.FLAGS.GetRcode())
+			assert.Equal(t, 0, len(cached.Answers))
+			assert.Equal(t, TypeSOA, cached.Authority[0].Type)
+			assert.Equal(t, test.expectedTTL-10, cached.Authority[0].TTL)
+
+			*now = now.Add(time.Duration(test.expectedTTL-10) * time.Second)
+			_, ok = cache.Get(question)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCacheSkipsNegativeWithoutSOA(t *testing.T) {
+	cache, _ := newTestCache(10)
+	question := newTestCacheQuery("missing.mfranc.com")
+
+	nxdomain := DNSMessage{}
+	err := nxdomain.Header.FLAGS.SetRcode(RcodeNameError)
+	assert.NoError(t, err)
+	cache.Set(question, nxdomain)
+
+	// referral - no answers and NS instead of SOA in authority
+	ns, err := NewAnswer("mfranc.com", ClassIN, 300, &RDataNS{Host: "ns1.mfranc.com"})
+	assert.NoError(t, err)
+	cache.Set(question, DNSMessage{Authority: []DNSAnswer{ns}})
+
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheServesStale(t *testing.T) {
+	cache, now := newTestCache(10)
+	cache.MaxStale = time.Hour
+	question := newTestCacheQuery("mfranc.com")
+
+	_, ok := cache.GetStale(question)
+	assert.False(t, ok)
+
+	cache.Set(question, newTestCacheResponse(t, "mfranc.com", 300))
+
+	// fresh answer is served as usual
+	*now = now.Add(100 * time.Second)
+	stale, ok := cache.GetStale(question)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(200), stale.Answers[0].TTL)
+
+	*now = now.Add(200 * time.Second)
+	_, ok = cache.Get(question)
+	assert.False(t, ok)
+
+	// failure doesn't replace the last good answer
+	failed := newTestCacheResponse(t, "mfranc.com", 60)
+	err := failed.Header.FLAGS.SetRcode(RcodeServerFailure)
+	assert.NoError(t, err)
+	cache.Set(question, failed)
+
+	stale, ok = cache.GetStale(question)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), stale.Answers[0].TTL)
+	assert.Equal(t, RcodeSuccess, stale.Header.FLAGS.GetRcode())
+
+	*now = now.Add(time.Hour)
+	_, ok = cache.GetStale(question)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheWithoutMaxStale(t *testing.T) {
+	cache, now := newTestCache(10)
+	question := newTestCacheQuery("mfranc.com")
+
+	cache.Set(question, newTestCacheResponse(t, "mfranc.com", 60))
+
+	*now = now.Add(60 * time.Second)
+	_, ok := cache.GetStale(question)
+	assert.False(t, ok)
+}
+
+func TestCacheRefreshesPopularAnswers(t *testing.T) {
+	cache, now := newTestCache(10)
+	popular := newTestCacheQuery("popular.mfranc.com")
+	rare := newTestCacheQuery("rare.mfranc.com")
+
+	cache.Set(popular, newTestCacheResponse(t, "popular.mfranc.com", 100))
+	cache.Set(rare, newTestCacheResponse(t, "rare.mfranc.com", 100))
+
+	for range refreshHits - 1 {
+		_, state := cache.lookup(popular)
+		assert.Equal(t, cacheFresh, state)
+	}
+
+	// popular but still far from expiry
+	*now = now.Add(89 * time.Second)
+	_, state := cache.lookup(popular)
+	assert.Equal(t, cacheFresh, state)
+
+	*now = now.Add(time.Second)
+	_, state = cache.lookup(popular)
+	assert.Equal(t, cacheRefresh, state)
+	_, state = cache.lookup(rare)
+	assert.Equal(t, cacheFresh, state)
+
+	// refresh is already in progress
+	_, state = cache.lookup(popular)
+	assert.Equal(t, cacheFresh, state)
+
+	// new answer counts hits from the start
+	cache.Set(popular, newTestCacheResponse(t, "popular.mfranc.com", 100))
+	*now = now.Add(95 * time.Second)
+	_, state = cache.lookup(popular)
+	assert.Equal(t, cacheFresh, state)
+}
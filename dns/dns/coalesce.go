@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// query to resolver in progress - everyone asking the same question meanwhile waits for its answer
+type flight struct {
+	done     chan struct{}
+	response DNSMessage
+	err      error
+}
+
+// coalescer makes sure only one query per question goes to resolver at a time
+// when many clients ask for the same name at the same moment (popular name just expired from cache)
+// all of them get the answer of the first query instead of sending their own
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[cacheKey]*flight
+
+	started   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+// do calls fn unless there is already a call for the same query in progress - see cacheKey for what is the same
+// in that case it waits for that call and returns its answer
+// the answer is shared between all the callers so it mustn't be modified
+func (c *coalescer) do(ctx context.Context, query DNSMessage, fn func() (DNSMessage, error)) (DNSMessage, error) {
+	key := newCacheKey(query)
+
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		c.coalesced.Add(1)
+
+		select {
+		case <-f.done:
+			return f.response, f.err
+		case <-ctx.Done():
+			// the query we wait for goes on for the others
+			return DNSMessage{}, fmt.Errorf("stopped waiting for resolver answer: %w", ctx.Err())
+		}
+	}
+
+	if c.flights == nil {
+		c.flights = map[cacheKey]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+	c.started.Add(1)
+
+	f.response, f.err = fn()
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.response, f.err
+}
+
+// ForwardingStats counts questions that needed an answer from resolver
+type ForwardingStats struct {
+	// questions actually sent to resolver
+	UpstreamQueries uint64
+	// questions that waited for the same question already sent to resolver instead of sending their own
+	CoalescedQueries uint64
+}
+
+// DedupRatio returns the part of questions for resolver that didn't have to be sent, between 0 and 1
+func (s ForwardingStats) DedupRatio() float64 {
+	total := s.UpstreamQueries + s.CoalescedQueries
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CoalescedQueries) / float64(total)
+}
+
+func (s ForwardingStats) String() string {
+	return fmt.Sprintf("upstream queries: %d, coalesced: %d, dedup ratio: %.2f%%",
+		s.UpstreamQueries, s.CoalescedQueries, 100*s.DedupRatio())
+}
@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescerSharesAnswer(t *testing.T) {
+	var c coalescer
+	question := newTestCacheQuery("mfranc.com")
+	release := make(chan struct{})
+	answer := newTestCacheResponse(t, "mfranc.com", 60)
+
+	leader := make(chan DNSMessage, 1)
+	go func() {
+		response, err := c.do(context.Background(), question, func() (DNSMessage, error) {
+			<-release
+			return answer, nil
+		})
+		assert.NoError(t, err)
+		leader <- response
+	}()
+	assert.Eventually(t, func() bool { return c.started.Load() == 1 }, time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// same question with different case
+			response, err := c.do(context.Background(), newTestCacheQuery("MFRANC.com"), func() (DNSMessage, error) {
+				t.Error("identical question sent to resolver again")
+				return DNSMessage{}, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, answer, response)
+		}()
+	}
+	assert.Eventually(t, func() bool { return c.coalesced.Load() == 5 }, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, answer, <-leader)
+
+	// once the answer is there the next question goes to resolver again
+	_, err := c.do(context.Background(), question, func() (DNSMessage, error) {
+		return DNSMessage{}, errors.New("resolver failed")
+	})
+	assert.EqualError(t, err, "resolver failed")
+	assert.Equal(t, uint64(2), c.started.Load())
+}
+
+func TestCoalescerKeepsQuestionsApart(t *testing.T) {
+	var c coalescer
+	release := make(chan struct{})
+
+	go func() {
+		_, _ = c.do(context.Background(), newTestCacheQuery("mfranc.com"), func() (DNSMessage, error) {
+			<-release
+			return DNSMessage{}, nil
+		})
+	}()
+	assert.Eventually(t, func() bool { return c.started.Load() == 1 }, time.Second, time.Millisecond)
+	defer close(release)
+
+	aaaa := DNSMessage{Questions: []DNSQuestion{{Name: EncodeName("mfranc.com"), Type: TypeAAAA, Class: ClassIN}}}
+	_, err := c.do(context.Background(), aaaa, func() (DNSMessage, error) { return DNSMessage{}, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), c.started.Load())
+	assert.Equal(t, uint64(0), c.coalesced.Load())
+}
+
+func TestCoalescerWaiterGivesUp(t *testing.T) {
+	var c coalescer
+	question := newTestCacheQuery("mfranc.com")
+	release := make(chan struct{})
+	defer close(release)
+
+	go func() {
+		_, _ = c.do(context.Background(), question, func() (DNSMessage, error) {
+			<-release
+			return DNSMessage{}, nil
+		})
+	}()
+	assert.Eventually(t, func() bool { return c.started.Load() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.do(ctx, question, func() (DNSMessage, error) { return DNSMessage{}, nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestForwardingStats(t *testing.T) {
+	assert.Equal(t, 0.0, ForwardingStats{}.DedupRatio())
+
+	stats := ForwardingStats{UpstreamQueries: 1, CoalescedQueries: 3}
+	assert.Equal(t, 0.75, stats.DedupRatio())
+	assert.Equal(t, "upstream queries: 1, coalesced: 3, dedup ratio: 75.00%", stats.String())
+}
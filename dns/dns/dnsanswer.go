@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+type DNSAnswer struct {
+	Name   []byte
+	Type   uint16
+	Class  uint16
+	TTL    uint32
+	Length uint16
+	Data   []byte
+}
+
+func (answer *DNSAnswer) Encode() ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	buf.Write(answer.Name)
+	if err := binary.Write(buf, binary.BigEndian, answer.Type); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, answer.Class); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, answer.TTL); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, answer.Length); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, answer.Data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Answer has dynamic sized fields like Name which require to read it step by step
+func (answer *DNSAnswer) Decode(messageBytes []byte, offset int) (int, error) {
+	name, offsetName, err := ExtractName(messageBytes, offset)
+	if err != nil {
+		return -1, err
+	}
+	offset += offsetName
+	answer.Name = name
+
+	//TODO: this logic currently requires specific order and can be error prone
+	answer.Type, offset, err = ReadUint16(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read answer type: %w", err)
+	}
+	answer.Class, offset, err = ReadUint16(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read answer class: %w", err)
+	}
+	answer.TTL, offset, err = ReadUint32(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read answer ttl: %w", err)
+	}
+	answer.Length, offset, err = ReadUint16(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read answer data length: %w", err)
+	}
+
+	// RDLENGTH tells how many bytes of RDATA follow - A is 4 bytes, AAAA is 16, CNAME/MX/TXT are variable
+	// we have to honor it for every type otherwise next record in the message is read from the wrong offset
+	dataEnd := offset + int(answer.Length)
+	if dataEnd > len(messageBytes) {
+		return -1, fmt.Errorf("answer data length %d exceeds message size %d at offset %d: %w", answer.Length, len(messageBytes), offset, ErrTruncated)
+	}
+
+	if hasNameInRData(answer.Type) {
+		// names in rdata can be compressed pointing to other parts of this message
+		// so we store them decompressed - this way the answer can be safely copied into another message
+		answer.Data, err = decompressRData(answer.Type, messageBytes, offset, answer.Length)
+		if err != nil {
+			return -1, fmt.Errorf("failed to decode rdata of type %d: %w", answer.Type, err)
+		}
+		answer.Length = uint16(len(answer.Data))
+	} else {
+		// copy so the answer does not keep a reference to the (often reused) read buffer
+		answer.Data = append([]byte{}, messageBytes[offset:dataEnd]...)
+	}
+	offset = dataEnd
+
+	return offset, nil
+}
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import (
 	"github.com/stretchr/testify/assert"
@@ -63,7 +63,7 @@ func TestDNSAnswerWithStaticVariablesEncode(t *testing.T) {
 
 func TestDNSAnswerWithNameEncoding(t *testing.T) {
 
-	testName := nameEncoder("1")
+	testName := EncodeName("1")
 
 	answer := DNSAnswer{
 		Name: testName,
@@ -83,7 +83,7 @@ func TestDNSAnswerWithNameEncoding(t *testing.T) {
 
 func TestDNSAnswerWithDataEncoding(t *testing.T) {
 
-	testData, err := ipV4Encoder("8.8.8.8")
+	testData, err := EncodeIPv4("8.8.8.8")
 	assert.NoError(t, err)
 
 	answer := DNSAnswer{
@@ -105,11 +105,11 @@ func TestDNSAnswerWithDataEncoding(t *testing.T) {
 }
 
 func TestDNSAnswerEncodeDecode(t *testing.T) {
-	testData, err := ipV4Encoder("8.8.8.8")
+	testData, err := EncodeIPv4("8.8.8.8")
 	assert.NoError(t, err)
 
 	answer := DNSAnswer{
-		Name:   nameEncoder("mfranc.com"),
+		Name:   EncodeName("mfranc.com"),
 		Type:   1,
 		Class:  5,
 		TTL:    1000,
@@ -129,3 +129,86 @@ func TestDNSAnswerEncodeDecode(t *testing.T) {
 
 	assert.Equal(t, answer, decodedAnswer)
 }
+
+func TestDNSAnswerDecodeHonorsLength(t *testing.T) {
+	aaaa := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1} // 2001:db8::1
+	txt := []byte{0x05, 'h', 'e', 'l', 'l', 'o'}
+	cname := EncodeName("target.mfranc.com")
+
+	answers := []DNSAnswer{
+		{Name: EncodeName("mfranc.com"), Type: 28, Class: 1, TTL: 60, Length: uint16(len(aaaa)), Data: aaaa},
+		{Name: EncodeName("mfranc.com"), Type: 16, Class: 1, TTL: 60, Length: uint16(len(txt)), Data: txt},
+		{Name: EncodeName("www.mfranc.com"), Type: 5, Class: 1, TTL: 60, Length: uint16(len(cname)), Data: cname},
+	}
+
+	// records are encoded one after another so that wrong length would shift the next record
+	var encoded []byte
+	for _, answer := range answers {
+		answerEncoded, err := answer.Encode()
+		assert.NoError(t, err)
+		encoded = append(encoded, answerEncoded...)
+	}
+
+	offset := 0
+	for _, expected := range answers {
+		decodedAnswer := DNSAnswer{}
+		var err error
+		offset, err = decodedAnswer.Decode(encoded, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decodedAnswer)
+	}
+	assert.Equal(t, len(encoded), offset)
+}
+
+func TestDNSAnswerDecodeLengthPastMessage(t *testing.T) {
+	answer := DNSAnswer{
+		Name:   EncodeName("mfranc.com"),
+		Type:   1,
+		Class:  1,
+		TTL:    60,
+		Length: 4,
+		Data:   []byte{8, 8, 8, 8},
+	}
+
+	answerEncoded, err := answer.Encode()
+	assert.NoError(t, err)
+
+	// cut last 2 bytes of the data so RDLENGTH points past the message
+	decodedAnswer := DNSAnswer{}
+	_, err = decodedAnswer.Decode(answerEncoded[:len(answerEncoded)-2], 0)
+	assert.Error(t, err)
+}
+
+func TestDNSAnswerDecodeDecompressesRDataLabels(t *testing.T) {
+	owner := EncodeName("example.com")
+	values := make([]byte, 20)
+	values[3] = 1 // serial
+
+	// mname points to the owner, rname is the single label "john.doe" followed by pointer to the owner
+	rdata := append([]byte{0xc0, 0x00, 0x08}, "john.doe"...)
+	rdata = append(rdata, 0xc0, 0x00)
+	rdata = append(rdata, values...)
+
+	message := append([]byte{}, owner...)
+	message = append(message, 0, byte(TypeSOA), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+	message = append(message, rdata...)
+
+	answer := DNSAnswer{}
+	offset, err := answer.Decode(message, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, len(message), offset)
+
+	expected := append([]byte{}, owner...)
+	expected = append(expected, 0x08)
+	expected = append(expected, "john.doe"...)
+	expected = append(expected, owner...)
+	expected = append(expected, values...)
+	assert.Equal(t, expected, answer.Data)
+	assert.Equal(t, uint16(len(expected)), answer.Length)
+
+	// rdata can't have anything after the names that its type doesn't define
+	message[len(owner)+9]++
+	message = append(message, 0)
+	_, err = (&DNSAnswer{}).Decode(message, 0)
+	assert.Error(t, err)
+}
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import "fmt"
 
@@ -68,6 +68,18 @@ func (f *Flags) SetRA(value bool) {
 	}
 }
 
+// CD (checking disabled) is the lowest bit of what RFC 1035 calls Z - https://www.rfc-editor.org/rfc/rfc4035#section-3.2.2
+// client asks resolver not to validate DNSSEC signatures
+func (f *Flags) GetCD() bool {
+	return hasBit(f.Value, 4)
+}
+
+func (f *Flags) SetCD(value bool) {
+	if value {
+		f.Value = setBit(f.Value, 4)
+	}
+}
+
 func (f *Flags) GetZ() uint16 {
 	mask := uint16(16 + 32 + 64)
 	return (f.Value & mask) >> 4
@@ -90,8 +102,10 @@ func (f *Flags) GetRcode() uint16 {
 
 func (f *Flags) SetRcode(value uint16) (err error) {
 	if value >= 16 {
-		return fmt.Errorf("invalid z value set - allowed 0 to 15: %d", value)
+		return fmt.Errorf("invalid rcode value set - allowed 0 to 15: %d", value)
 	}
+	// clear the previous rcode first so setting it twice doesn't mix the bits
+	f.Value &^= uint16(1 + 2 + 4 + 8)
 	mask := value
 	f.Value |= mask
 
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import (
 	"github.com/stretchr/testify/assert"
@@ -98,6 +98,13 @@ func TestHeaderRCcode(t *testing.T) {
 
 	err = testHeader.SetRcode(16)
 	assert.Error(t, err)
+
+	// setting rcode again replaces the previous one and leaves other flags alone
+	testHeader.SetQR(true)
+	err = testHeader.SetRcode(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(2), testHeader.GetRcode())
+	assert.True(t, testHeader.GetQR())
 }
 
 func TestHeaderOpCode(t *testing.T) {
@@ -116,3 +123,14 @@ func TestHeaderOpCode(t *testing.T) {
 	err = testHeader.SetOpCode(16)
 	assert.Error(t, err)
 }
+
+func TestHeaderCD(t *testing.T) {
+	testHeader := Flags{}
+
+	assert.False(t, testHeader.GetCD())
+
+	testHeader.SetCD(true)
+
+	assert.True(t, testHeader.GetCD())
+	assert.Equal(t, uint16(1), testHeader.GetZ())
+}
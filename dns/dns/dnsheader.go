@@ -1,10 +1,14 @@
-package main
+package dns
 
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
+// header has fixed size of 12 bytes
+const HeaderSize = 12
+
 type DNSHeader struct {
 	ID      uint16
 	FLAGS   Flags
@@ -27,8 +31,12 @@ func (h *DNSHeader) Encode() ([]byte, error) {
 
 // header has all the fields as fixed size and we  can just use binary Read
 func (h *DNSHeader) Decode(messageBytes []byte) error {
+	if len(messageBytes) < HeaderSize {
+		return fmt.Errorf("header needs %d bytes got %d: %w", HeaderSize, len(messageBytes), ErrTruncated)
+	}
+
 	// header uses only first 12 bytes
-	headerBuffer := bytes.NewBuffer(messageBytes[0:12])
+	headerBuffer := bytes.NewBuffer(messageBytes[0:HeaderSize])
 	err := binary.Read(headerBuffer, binary.BigEndian, h)
 	if err != nil {
 		return err
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import (
 	"github.com/stretchr/testify/assert"
@@ -128,3 +128,13 @@ func TestHeaderWithANCountEncoding(t *testing.T) {
 	// QD Count occupies 5th and 6th bit
 	assert.Equal(t, encodedHeader, []byte{0, 0, 0, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0}, "Header with ANCount not encoded correctly")
 }
+
+func TestHeaderDecodeTruncated(t *testing.T) {
+	header := DNSHeader{}
+
+	err := header.Decode([]byte{0, 1, 0, 0, 0, 0})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	err = header.Decode([]byte{})
+	assert.ErrorIs(t, err, ErrTruncated)
+}
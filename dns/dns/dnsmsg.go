@@ -0,0 +1,458 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type DNSMessage struct {
+	Header    DNSHeader
+	Questions []DNSQuestion
+	Answers   []DNSAnswer
+	// Authority and Additional use the same resource record layout as answers
+	// authority carries NS referrals and SOA for negative answers, additional carries glue records
+	Authority  []DNSAnswer
+	Additional []DNSAnswer
+}
+
+func (message *DNSMessage) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	compressor := newNameCompressor()
+
+	encodedHeader, err := message.Header.Encode()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(encodedHeader)
+
+	// question and record are copies so replacing names with compressed ones doesn't touch the message
+	for _, question := range message.Questions {
+		question.Name = compressor.compress(question.Name, buf.Len())
+		encodedQuestion, err := question.Encode()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodedQuestion)
+	}
+
+	// answer, authority and additional sections are all resource records and are written in this order
+	for _, section := range [][]DNSAnswer{message.Answers, message.Authority, message.Additional} {
+		for _, record := range section {
+			record.Name = compressor.compress(record.Name, buf.Len())
+			if canCompressRData(record.Type) {
+				// rdata starts after the name and 10 bytes of type, class, ttl and rdlength
+				record.Data = compressor.compressRData(record.Type, record.Data, buf.Len()+len(record.Name)+10)
+				record.Length = uint16(len(record.Data))
+			}
+			encodedRecord, err := record.Encode()
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(encodedRecord)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (message *DNSMessage) Decode(messageBytes []byte) error {
+
+	message.Header = DNSHeader{}
+	message.Questions = []DNSQuestion{}
+	message.Answers = []DNSAnswer{}
+	message.Authority = []DNSAnswer{}
+	message.Additional = []DNSAnswer{}
+
+	err := message.Header.Decode(messageBytes)
+	if err != nil {
+		return err
+	}
+
+	// question section starts right after the header
+	offset := HeaderSize
+	for range message.Header.QDCOUNT {
+		question := DNSQuestion{}
+		offset, err = question.Decode(messageBytes, offset)
+		if err != nil {
+			return fmt.Errorf("failure in decoding message on decoding question: %w", err)
+		}
+		message.Questions = append(message.Questions, question)
+	}
+
+	message.Answers, offset, err = decodeRecords(messageBytes, offset, message.Header.ANCOUNT, message.Answers)
+	if err != nil {
+		return fmt.Errorf("failure in decoding message on decoding answer: %w", err)
+	}
+
+	message.Authority, offset, err = decodeRecords(messageBytes, offset, message.Header.NSCOUNT, message.Authority)
+	if err != nil {
+		return fmt.Errorf("failure in decoding message on decoding authority: %w", err)
+	}
+
+	message.Additional, _, err = decodeRecords(messageBytes, offset, message.Header.ARCOUNT, message.Additional)
+	if err != nil {
+		return fmt.Errorf("failure in decoding message on decoding additional: %w", err)
+	}
+
+	err = validateOPT(message)
+	if err != nil {
+		return fmt.Errorf("failure in decoding message on validating OPT: %w", err)
+	}
+
+	return nil
+}
+
+// answer, authority and additional sections share the same resource record format
+// so one loop decodes `count` records starting at offset and appends them to records
+func decodeRecords(messageBytes []byte, offset int, count uint16, records []DNSAnswer) ([]DNSAnswer, int, error) {
+	for range count {
+		record := DNSAnswer{}
+		var err error
+		offset, err = record.Decode(messageBytes, offset)
+		if err != nil {
+			return nil, -1, err
+		}
+		records = append(records, record)
+	}
+
+	return records, offset, nil
+}
+
+func extractPointer(word []byte) (int, error) {
+
+	if len(word) != 2 {
+		return -1, fmt.Errorf("provided word is not 2 bytes in size unable to proceed to extract pointer")
+	}
+
+	w := binary.BigEndian.Uint16(word)
+
+	// in the rfc - https://www.rfc-editor.org/rfc/rfc1035#section-4.1.4
+	// if last two bits are 11 then its a pointer
+	if hasBit(w, 15) && hasBit(w, 14) {
+		// generates 1100 0000 0000 0000
+		mask := 11 << 14
+
+		// &^= does and not operation and will clear the bits that have 11
+		// this will set zero if both w and mask are 1 and otherwise use the w
+		// to remove pointer  indication and create a value from the rest of bits
+		// which is the actuall offset value
+		w &^= uint16(mask)
+
+		return int(w), nil
+	} else {
+		// this was not a pointer
+		return -1, nil
+	}
+}
+
+// pointer has 14 bits for the offset so names placed further than that can't be pointed to
+const maxPointerOffset = 0x3FFF
+
+// This is the mirror image of extractPointer and ExtractName - https://www.rfc-editor.org/rfc/rfc1035#section-4.1.4
+// while encoding a message we remember at which offset every name suffix was written
+// next time the same suffix shows up we write a pointer to it instead of the labels
+// example: www.example.com at offset 12 stores
+// - www.example.com -> 12
+// - example.com -> 16
+// - com -> 24
+// so mail.example.com later on becomes \x04mail\xc0\x10
+// table is per message as offsets only make sense within the message they were written to
+type nameCompressor struct {
+	offsets map[string]int
+}
+
+func newNameCompressor() *nameCompressor {
+	return &nameCompressor{offsets: map[string]int{}}
+}
+
+// takes uncompressed name and the offset in the message at which it will be written
+// returns bytes that should be written - either the same name or labels ending with a pointer
+func (c *nameCompressor) compress(name []byte, messageOffset int) []byte {
+	offset := 0
+	for offset < len(name) && name[offset] != 0x00 {
+		lengthOfLabel := int(name[offset])
+
+		// we only compress clean uncompressed names - anything else is written as is
+		if lengthOfLabel > 63 || offset+lengthOfLabel+1 >= len(name) {
+			return name
+		}
+
+		// exact bytes are used as a key so that the case of the name is kept as it was
+		suffix := string(name[offset:])
+		if pointer, ok := c.offsets[suffix]; ok {
+			buf := new(bytes.Buffer)
+			buf.Write(name[:offset])
+			// 11 in the two highest bits marks the pointer
+			buf.WriteByte(byte(0xC0 | pointer>>8))
+			buf.WriteByte(byte(pointer))
+			return buf.Bytes()
+		}
+
+		if messageOffset+offset <= maxPointerOffset {
+			c.offsets[suffix] = messageOffset + offset
+		}
+
+		offset += lengthOfLabel + 1
+	}
+
+	return name
+}
+
+// https://www.rfc-editor.org/rfc/rfc3597#section-4 - only the well known types from rfc1035 can have
+// compressed names in rdata, newer types like SRV have to be written uncompressed as old resolvers wouldn't know them
+func canCompressRData(rrType uint16) bool {
+	switch rrType {
+	case TypeCNAME, TypeNS, TypePTR, TypeMX, TypeSOA:
+		return true
+	}
+	return false
+}
+
+// data is expected to be uncompressed - this is what DNSAnswer.Decode and NewAnswer produce
+func (c *nameCompressor) compressRData(rrType uint16, data []byte, rdataOffset int) []byte {
+	switch rrType {
+	case TypeCNAME, TypeNS, TypePTR:
+		return c.compress(data, rdataOffset)
+	case TypeMX:
+		if len(data) < 3 {
+			return data
+		}
+		// 2 bytes of preference then exchange name
+		return append(append([]byte{}, data[:2]...), c.compress(data[2:], rdataOffset+2)...)
+	case TypeSOA:
+		mnameLength := encodedNameLength(data)
+		if mnameLength == -1 {
+			return data
+		}
+		rnameLength := encodedNameLength(data[mnameLength:])
+		if rnameLength == -1 {
+			return data
+		}
+
+		mname := c.compress(data[:mnameLength], rdataOffset)
+		rname := c.compress(data[mnameLength:mnameLength+rnameLength], rdataOffset+len(mname))
+
+		compressed := append(append([]byte{}, mname...), rname...)
+		return append(compressed, data[mnameLength+rnameLength:]...)
+	}
+	return data
+}
+
+// length in bytes of uncompressed name at the start of data including the ending 0 or -1 if it's not a valid name
+func encodedNameLength(data []byte) int {
+	offset := 0
+	for offset < len(data) {
+		lengthOfLabel := int(data[offset])
+		if lengthOfLabel == 0 {
+			return offset + 1
+		}
+		if lengthOfLabel > 63 {
+			return -1
+		}
+		offset += lengthOfLabel + 1
+	}
+	return -1
+}
+
+// ExtractName will find a name in the byte array starting at startOffset
+// If compression found will decompress the name
+// returns
+// - byte representation of name
+// - offset by which one should shift the bytes
+func ExtractName(data []byte, startOffset int) ([]byte, int, error) {
+	offset := startOffset
+	lengthOfLabelSection := 0
+	hasPointer := false
+	buf := new(bytes.Buffer)
+
+	// every pointer target we jumped to - coming back to one of them means malicious dns query or a mistake somewhere
+	visitedPointers := map[int]bool{}
+
+	// find the length of the name by counting offset in bytes by traversing  the encoded name
+	// it reads the length adds it to offset until if finds 0 value which indicates the end of the encoded name
+
+	for {
+		// message can be cut in the middle of the name - we need at least the length byte
+		if offset < 0 || offset >= len(data) {
+			return nil, -1, fmt.Errorf("name extraction failed at offset %d: %w", offset, ErrTruncated)
+		}
+
+		// we check if we  have found a label ending with pointer
+		// This  has to be a first check as pointer has a special structure with two bits set to one
+		// if this wouldnt be the first check pointer could be mistaken to be naext label size
+		// if we found pointer then we need write the label + shift the offset and move it to pointer
+
+		// example of message with pointer
+		// \0x03f00\x0c
+		// \x0c is the pointer with the length 0
+		if data[offset]&0xC0 == 0xC0 {
+			if offset+2 > len(data) {
+				return nil, -1, fmt.Errorf("name extraction failed on pointer at offset %d: %w", offset, ErrTruncated)
+			}
+			pointer, err := extractPointer(data[offset : offset+2])
+			if err != nil {
+				return nil, -1, fmt.Errorf("name extraction failed: %w", err)
+			}
+
+			// pointer can only go back to something that was already written before it
+			// pointing to itself or forward could make us jump around forever
+			if pointer == offset || visitedPointers[pointer] {
+				return nil, -1, fmt.Errorf("name extraction failed on pointer to %d at offset %d: %w", pointer, offset, ErrPointerLoop)
+			}
+			if pointer > offset {
+				return nil, -1, fmt.Errorf("name extraction failed on pointer to %d at offset %d: %w", pointer, offset, ErrForwardPointer)
+			}
+			visitedPointers[pointer] = true
+
+			// everything up to the pointer is start of the message so we need to write it
+			buf.Write(data[startOffset:offset])
+
+			// we need to add +2 as pointer occupies the last two bytes of the  label
+			// only the first pointer counts - pointer can lead to a name that ends with another pointer
+			// but that doesn't change how many bytes the name takes at its original place
+			if !hasPointer {
+				lengthOfLabelSection = (offset + 2) - startOffset
+			}
+
+			// reset the offset to the pointer so that we can jump to a label that probably doesnt have pointer
+			offset = pointer
+			startOffset = pointer
+			hasPointer = true
+			continue
+		}
+
+		// loop through bytes and the lenghts of labels till you reach the end or pointer
+		lengthOflabel := data[offset]
+
+		// 01 and 10 in top bits are extended label types that nobody uses - for us it's just too long label
+		if lengthOflabel > 63 {
+			return nil, -1, fmt.Errorf("name extraction failed on label of length %d at offset %d: %w", lengthOflabel, offset, ErrLabelTooLong)
+		}
+
+		// +1 here as the first byte is the lenght value so we ddont want to miss it
+		// label is | length | char | char | char ... etc
+		offset += int(lengthOflabel) + 1
+
+		// this is just a precatuion so we dont read past the message
+		if offset > len(data) {
+			return nil, -1, fmt.Errorf("name extraction failed: label runs past the message: %w", ErrTruncated)
+		}
+
+		// name with all the labels and the ending 0 can't be bigger than 255
+		if buf.Len()+offset-startOffset > 255 {
+			return nil, -1, fmt.Errorf("name extraction failed: %w", ErrNameTooLong)
+		}
+
+		if lengthOflabel == 0x00 {
+			if !hasPointer {
+				lengthOfLabelSection = offset - startOffset
+			}
+			buf.Write(data[startOffset:offset])
+			break
+		}
+	}
+
+	return buf.Bytes(), lengthOfLabelSection, nil
+}
+
+// EncodeName turns dotted name into wire format
+// split by . (but not by escaped \. which is a dot inside the label - see splitName)
+// then for each splitted item create encoded value and add to buf
+// encoded value example de => \x02de --- length 2 and then characters (or runes)
+// then emit buff adding \x00 at the end - this is to indicate the end of label - important for decoding!
+func EncodeName(name string) []byte {
+	if name == "" {
+		// we need to return 0 as this is indicating the end of the name
+		return []byte{0x00}
+	}
+
+	buf := new(bytes.Buffer)
+	split := splitName(name)
+	for _, v := range split {
+		length := len(v)
+
+		buf.WriteByte(uint8(length)) // uint8 is important here as the number  has to occupy 1 byte
+		buf.Write([]byte(v))
+	}
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// DecodeName is mirror of EncodeName - takes uncompressed name as returned by ExtractName
+// and joins labels with `.`  \x03www\x07example\x03com\x00 => www.example.com
+// dot and backslash inside the label are escaped so EncodeName gets the same labels back - \x08john.doe => john\.doe
+func DecodeName(encoded []byte) string {
+	var labels []string
+	for offset := 0; offset < len(encoded); {
+		length := int(encoded[offset])
+		if length == 0 || offset+1+length > len(encoded) {
+			break
+		}
+		label := string(encoded[offset+1 : offset+1+length])
+		label = strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(label)
+		labels = append(labels, label)
+		offset += length + 1
+	}
+	return strings.Join(labels, ".")
+}
+
+// splitName splits dotted name into labels the way master files write them - https://www.rfc-editor.org/rfc/rfc1035#section-5.1
+// \X is the character X (so \. is a dot inside the label) and \DDD is a byte given in decimal
+func splitName(name string) []string {
+	var labels []string
+	var label strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '.':
+			labels = append(labels, label.String())
+			label.Reset()
+		case c == '\\' && i+3 < len(name) && isDigits(name[i+1:i+4]) && name[i+1:i+4] <= "255":
+			value, _ := strconv.Atoi(name[i+1 : i+4])
+			label.WriteByte(byte(value))
+			i += 3
+		case c == '\\' && i+1 < len(name):
+			label.WriteByte(name[i+1])
+			i++
+		default:
+			label.WriteByte(c)
+		}
+	}
+	return append(labels, label.String())
+}
+
+// EncodeIPv4 turns dotted address into 4 bytes of A record data
+// split by .
+// then for each splitted item create encoded value and add to buf
+// example 8.8.8.8 -> 8888
+// we effectively just remove `dot`
+// but we cant just encode 8888 in byte it has be 8 8 8 8 each in 1 byte that is why simple algorithm to `remove .` won't work here
+func EncodeIPv4(ip string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	split := strings.Split(ip, ".")
+
+	if len(split) != 4 {
+		return nil, fmt.Errorf("invalid IP address ip: %s", ip)
+	}
+
+	for _, v := range split {
+		value, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failure when parsing sub value %v in ip: %s", v, ip)
+		}
+
+		if value > 255 || value < 0 {
+			return nil, fmt.Errorf("the parsed value is not within the the ipv4 limit - value: %v in ip %s", value, ip)
+		}
+
+		// uint8 is important here as the value has to  fit into 1 byte
+		if err := binary.Write(buf, binary.BigEndian, uint8(value)); err != nil {
+			return nil, fmt.Errorf("failure when writing value to buffer")
+		}
+	}
+
+	return buf.Bytes(), nil
+}
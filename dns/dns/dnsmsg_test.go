@@ -0,0 +1,424 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameEncoder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []byte
+	}{
+		{"www.example.com", []byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{"example.com", []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{"com", []byte{3, 'c', 'o', 'm', 0}},
+		{"", []byte{0}},
+		{"a.b.c", []byte{1, 'a', 1, 'b', 1, 'c', 0}},
+		{"sub.domain.example.com", []byte{3, 's', 'u', 'b', 6, 'd', 'o', 'm', 'a', 'i', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		// escaped dot is inside the label
+		{`a\.b.c`, []byte{3, 'a', '.', 'b', 1, 'c', 0}},
+		{`a\\.b`, []byte{2, 'a', '\\', 1, 'b', 0}},
+		{`a\066.c`, []byte{2, 'a', 'B', 1, 'c', 0}},
+	}
+
+	for _, test := range tests {
+		result := EncodeName(test.input)
+		assert.Equal(t, test.expected, result, "For input %q, expected %v, but got %v", test.input, test.expected, result)
+	}
+}
+
+func TestNameDecoder(t *testing.T) {
+	tests := []string{"www.example.com", "example.com", "com", "", "a.b.c", `john\.doe.example.com`, `back\\slash.com`}
+
+	for _, test := range tests {
+		assert.Equal(t, test, DecodeName(EncodeName(test)))
+	}
+}
+
+// Tests for EncodeIPv4 function
+func TestIpV4Encoder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []byte
+		err      bool
+	}{
+		{"192.168.1.1", []byte{192, 168, 1, 1}, false},
+		{"255.255.255.255", []byte{255, 255, 255, 255}, false},
+		{"0.0.0.0", []byte{0, 0, 0, 0}, false},
+		{"10.0.0.1", []byte{10, 0, 0, 1}, false},
+		{"256.100.50.25", nil, true}, // Value out of range
+		{"192.168.1", nil, true},     // Not enough parts
+		{"192.168.1.1.1", nil, true}, // Too many parts
+		{"192.168.1.a", nil, true},   // Non-numeric part
+		{"192.-1.1.1", nil, true},    // Negative value
+		{"192.168.1.300", nil, true}, // Out of range part
+	}
+
+	for _, test := range tests {
+		result, err := EncodeIPv4(test.input)
+		if test.err {
+			assert.Error(t, err, "For input %q, expected error: %v, but got: %v", test.input, test.err, err)
+		} else {
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, test.expected, result, "For input %q, expected %v, but got %v", test.input, test.expected, result)
+	}
+}
+
+func TestNameExtract(t *testing.T) {
+	// we  have 3 names here
+	// f.isi.arpa
+	// foo.f.isi.arpa
+	// arpa
+	data := []byte{0x01, 'f', 0x03, 'i', 's', 'i', 0x04, 'a', 'r', 'p', 'a', 0x00, 0x03, 'f', 'o', 'o', 0xc0, 0x00, 0xc0, 0x06}
+
+	tests := []struct {
+		expected []byte
+	}{
+		{[]byte{0x01, 'f', 0x03, 'i', 's', 'i', 0x04, 'a', 'r', 'p', 'a', 0x00}},
+		{[]byte{0x03, 'f', 'o', 'o', 0x01, 'f', 0x03, 'i', 's', 'i', 0x04, 'a', 'r', 'p', 'a', 0x00}},
+		{[]byte{0x04, 'a', 'r', 'p', 'a', 0x00}},
+	}
+
+	startOffset := 0
+	var result []byte
+	var err error
+
+	// This test assumes that tests struct order is stable
+	for _, test := range tests {
+		result, startOffset, err = ExtractName(data, startOffset)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, result)
+	}
+}
+
+// pointer leading to a name that ends with another pointer
+// the length returned has to be the size of the name at its original place not after the jumps
+func TestNameExtractChainedPointers(t *testing.T) {
+	// 0: example.com
+	// 13: ns1 + pointer to 0
+	// 19: pointer to 13
+	data := []byte{0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x03, 'n', 's', '1', 0xc0, 0x00, 0xc0, 0x0d}
+
+	result, length, err := ExtractName(data, 19)
+	assert.NoError(t, err)
+	assert.Equal(t, EncodeName("ns1.example.com"), result)
+	assert.Equal(t, 2, length)
+}
+
+// This is a test to verify if the logic will break with error and not let the infinite loop
+// 100 pointers assumed ass too much and indication that someone is trying to DDOS us
+func TestNameExtractWith100Pointers(t *testing.T) {
+
+	// special name that will lead to infinite loop
+	testData := []byte{0xc0, 0x00, 0xc0}
+
+	_, _, err := ExtractName(testData, 0)
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrPointerLoop)
+}
+
+func TestNameExtractErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		offset   int
+		expected error
+	}{
+		{"empty", []byte{}, 0, ErrTruncated},
+		{"no ending zero", []byte{0x03, 'c', 'o', 'm'}, 0, ErrTruncated},
+		{"label longer than data", []byte{0x05, 'c', 'o', 'm', 0x00}, 0, ErrTruncated},
+		{"half of a pointer", []byte{0x03, 'c', 'o', 'm', 0xc0}, 0, ErrTruncated},
+		{"pointer to itself", []byte{0xc0, 0x00}, 0, ErrPointerLoop},
+		// 2: pointer to 0, 0: label a followed by the same pointer at 2 - would read `a` forever
+		{"pointer loop", []byte{0x01, 'a', 0xc0, 0x00}, 2, ErrPointerLoop},
+		// 6: pointer to 0, 0: com + pointer to 6 - second jump goes forward
+		{"pointer back and forth", []byte{0x03, 'c', 'o', 'm', 0xc0, 0x06, 0xc0, 0x00}, 6, ErrForwardPointer},
+		{"pointer forward", []byte{0xc0, 0x02, 0x03, 'c', 'o', 'm', 0x00}, 0, ErrForwardPointer},
+		{"pointer past message", []byte{0xc0, 0xff}, 0, ErrForwardPointer},
+		{"label too long", append([]byte{64}, make([]byte, 65)...), 0, ErrLabelTooLong},
+		{"extended label type", []byte{0x80, 0x00}, 0, ErrLabelTooLong},
+	}
+
+	for _, test := range tests {
+		_, _, err := ExtractName(test.data, test.offset)
+		assert.ErrorIs(t, err, test.expected, test.name)
+	}
+
+	// 5 labels of 63 bytes is more than 255 bytes in total
+	var longName []byte
+	for range 5 {
+		longName = append(longName, 63)
+		longName = append(longName, make([]byte, 63)...)
+	}
+	longName = append(longName, 0x00)
+	_, _, err := ExtractName(longName, 0)
+	assert.ErrorIs(t, err, ErrNameTooLong)
+}
+
+// every prefix of a valid message is a truncated message and has to fail with an error instead of a panic
+func TestDecodeDNSMessageTruncated(t *testing.T) {
+	testMessage := DNSMessage{
+		Header: DNSHeader{ID: 1, QDCOUNT: 1, ANCOUNT: 2, ARCOUNT: 1},
+		Questions: []DNSQuestion{
+			{Name: EncodeName("www.example.com"), Type: TypeA, Class: ClassIN},
+		},
+	}
+	cname, err := NewAnswer("www.example.com", ClassIN, 60, &RDataCNAME{Target: "example.com"})
+	assert.NoError(t, err)
+	a, err := NewAnswer("example.com", ClassIN, 60, &RDataA{IP: net.ParseIP("10.0.0.1")})
+	assert.NoError(t, err)
+	testMessage.Answers = []DNSAnswer{cname, a}
+	err = testMessage.SetOPT(&OPTRecord{UDPPayloadSize: 1232, Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}})
+	assert.NoError(t, err)
+
+	encoded, err := testMessage.Encode()
+	assert.NoError(t, err)
+	assert.NoError(t, (&DNSMessage{}).Decode(encoded))
+
+	for size := range len(encoded) {
+		err := (&DNSMessage{}).Decode(encoded[:size])
+		assert.ErrorIs(t, err, ErrTruncated, "message cut at %d bytes", size)
+	}
+}
+
+func TestDecodeDNSMessage(t *testing.T) {
+
+	nameEncoded := EncodeName("google.com")
+	ipEncoded, err := EncodeIPv4("8.8.8.8")
+	if err != nil {
+		t.Error("Error while creating encoded ip", err)
+	}
+	testMessage := DNSMessage{
+		Header: DNSHeader{
+			ID:      1234,
+			QDCOUNT: 2,
+			ANCOUNT: 2,
+			NSCOUNT: 1,
+			ARCOUNT: 1,
+		},
+		Questions: []DNSQuestion{
+			{
+				Name:  nameEncoded,
+				Class: 1,
+				Type:  1,
+			},
+			{
+				Name:  nameEncoded,
+				Class: 1,
+				Type:  1,
+			},
+		},
+		Answers: []DNSAnswer{
+			{
+				Name:   nameEncoded,
+				Class:  1,
+				Type:   1,
+				TTL:    60,
+				Length: 4,
+				Data:   ipEncoded,
+			},
+			{
+				Name:   nameEncoded,
+				Class:  1,
+				Type:   1,
+				TTL:    60,
+				Length: 4,
+				Data:   ipEncoded,
+			},
+		},
+		Authority: []DNSAnswer{
+			{
+				Name:   nameEncoded,
+				Class:  1,
+				Type:   1,
+				TTL:    120,
+				Length: 4,
+				Data:   ipEncoded,
+			},
+		},
+		Additional: []DNSAnswer{
+			{
+				Name:   nameEncoded,
+				Class:  1,
+				Type:   1,
+				TTL:    180,
+				Length: 4,
+				Data:   ipEncoded,
+			},
+		},
+	}
+
+	testMessage.Header.FLAGS.SetQR(true)
+	testMessage.Header.FLAGS.SetAA(true)
+	testMessage.Header.FLAGS.SetRD(true)
+	err = testMessage.Header.FLAGS.SetZ(7)
+	if err != nil {
+		t.Error("Error while setting Z", err)
+	}
+	err = testMessage.Header.FLAGS.SetRcode(15)
+	if err != nil {
+		t.Error("Error while setting RCode", err)
+	}
+	testMessage.Header.FLAGS.SetRA(true)
+	err = testMessage.Header.FLAGS.SetOpCode(15)
+	if err != nil {
+		t.Error("Error while setting OPCode", err)
+	}
+
+	testMessageEncoded, err := testMessage.Encode()
+	if err != nil {
+		t.Error("Failed to encode response:", err)
+	}
+
+	result := DNSMessage{}
+	err = result.Decode(testMessageEncoded)
+	if err != nil {
+		t.Error("failed to decode the message:", err)
+	}
+
+	assert.Equal(t, testMessage.Header, result.Header)
+	assert.NotNil(t, result)
+	assert.Equal(t, 2, len(result.Answers))
+	assert.Equal(t, 2, len(result.Questions))
+	assert.Equal(t, 1, len(result.Authority))
+	assert.Equal(t, 1, len(result.Additional))
+	assert.Equal(t, testMessage, result)
+}
+
+// referral style response - no answers only NS in authority and glue A record in additional
+func TestDecodeDNSMessageWithoutAnswers(t *testing.T) {
+	ipEncoded, err := EncodeIPv4("10.0.0.53")
+	assert.NoError(t, err)
+
+	nsName := EncodeName("ns1.example.com")
+
+	testMessage := DNSMessage{
+		Header: DNSHeader{
+			ID:      42,
+			QDCOUNT: 1,
+			ANCOUNT: 0,
+			NSCOUNT: 1,
+			ARCOUNT: 1,
+		},
+		Questions: []DNSQuestion{
+			{Name: EncodeName("www.example.com"), Class: 1, Type: 1},
+		},
+		Answers: []DNSAnswer{},
+		Authority: []DNSAnswer{
+			{Name: EncodeName("example.com"), Class: 1, Type: 2, TTL: 3600, Length: uint16(len(nsName)), Data: nsName},
+		},
+		Additional: []DNSAnswer{
+			{Name: nsName, Class: 1, Type: 1, TTL: 3600, Length: 4, Data: ipEncoded},
+		},
+	}
+
+	testMessageEncoded, err := testMessage.Encode()
+	assert.NoError(t, err)
+
+	result := DNSMessage{}
+	err = result.Decode(testMessageEncoded)
+	assert.NoError(t, err)
+
+	assert.Equal(t, testMessage, result)
+}
+
+func TestNameCompressor(t *testing.T) {
+	compressor := newNameCompressor()
+
+	// first time name is written it is kept as is and all suffixes are remembered
+	assert.Equal(t, EncodeName("www.example.com"), compressor.compress(EncodeName("www.example.com"), 12))
+
+	// the same name is just a pointer to 12
+	assert.Equal(t, []byte{0xc0, 0x0c}, compressor.compress(EncodeName("www.example.com"), 40))
+
+	// example.com starts at 16 - after \x03www
+	assert.Equal(t, []byte{0x04, 'm', 'a', 'i', 'l', 0xc0, 0x10}, compressor.compress(EncodeName("mail.example.com"), 50))
+
+	// root name can't be compressed
+	assert.Equal(t, []byte{0x00}, compressor.compress(EncodeName(""), 60))
+
+	// nothing in common
+	assert.Equal(t, EncodeName("mfranc.org"), compressor.compress(EncodeName("mfranc.org"), 70))
+}
+
+func TestEncodeDNSMessageCompression(t *testing.T) {
+	name := EncodeName("www.example.com")
+	testMessage := DNSMessage{
+		Header: DNSHeader{ID: 1, QDCOUNT: 1, ANCOUNT: 3, NSCOUNT: 1},
+		Questions: []DNSQuestion{
+			{Name: name, Class: 1, Type: 1},
+		},
+		Authority:  []DNSAnswer{},
+		Additional: []DNSAnswer{},
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		answer, err := NewAnswer("www.example.com", ClassIN, 60, &RDataA{IP: net.ParseIP(ip)})
+		assert.NoError(t, err)
+		testMessage.Answers = append(testMessage.Answers, answer)
+	}
+	soa, err := NewAnswer("example.com", ClassIN, 60, &RDataSOA{MName: "ns1.example.com", RName: "admin.example.com", Serial: 1})
+	assert.NoError(t, err)
+	testMessage.Authority = append(testMessage.Authority, soa)
+
+	encoded, err := testMessage.Encode()
+	assert.NoError(t, err)
+
+	// every answer name is replaced by a pointer to the question name at offset 12
+	answerOffset := 12 + len(name) + 4
+	for range testMessage.Answers {
+		assert.Equal(t, []byte{0xc0, 0x0c}, encoded[answerOffset:answerOffset+2])
+		answerOffset += 2 + 10 + 4
+	}
+
+	uncompressedSize := 12 + len(name) + 4
+	for _, answer := range append(testMessage.Answers, soa) {
+		uncompressedSize += len(answer.Name) + 10 + len(answer.Data)
+	}
+	assert.Less(t, len(encoded), uncompressedSize)
+
+	// decoding brings back the uncompressed names - including the ones inside SOA rdata
+	result := DNSMessage{}
+	err = result.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, testMessage, result)
+}
+
+func TestExtractPointer(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected int
+	}{
+		{[]byte{0xC0, 0x00}, 0},  // 1100 0000 0000 0000 - after clearing pointer bits -> 0000 0000 0000 0000
+		{[]byte{0xC0, 0x01}, 1},  // 1100 0000 0000 0001 - after clearing pointer bits -> 0000 0000 0000 0001
+		{[]byte{0xC0, 0x10}, 16}, // 1100 0000 0001 0000 - after clearing pointer bits -> 0000 0000 0001 0000
+
+		// not a pointer
+		{[]byte{0x00, 0x00}, -1}, // 0000 0000 0000 0000 - after clearing pointer bits -> 0000 0000 0000 0000
+		{[]byte{0x80, 0x00}, -1}, // 1000 0000 0000 0000 - after clearing pointer bits -> 0000 0000 0000 0000
+		{[]byte{0x40, 0x00}, -1}, // 0100 0000 0000 0000 - after clearing pointer bits -> 0000 0000 0000 0000
+	}
+
+	for _, test := range tests {
+		result, err := extractPointer(test.input)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, result, "For input %v, expected %d, but got %d", test.input, test.expected, result)
+	}
+
+	// error case
+	tests = []struct {
+		input    []byte
+		expected int
+	}{
+		{[]byte{0xC0, 0x00, 0x00}, -1}, // 1100 0000 0000 0000 - after clearing pointer bits -> 0000 0000 0000 0000
+	}
+
+	for _, test := range tests {
+		_, err := extractPointer(test.input)
+		assert.Error(t, err)
+	}
+}
@@ -1,8 +1,9 @@
-package main
+package dns
 
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
 type DNSQuestion struct {
@@ -27,7 +28,7 @@ func (question *DNSQuestion) Encode() ([]byte, error) {
 }
 
 func (question *DNSQuestion) Decode(messageBytes []byte, offset int) (int, error) {
-	name, offsetName, err := nameExtract(messageBytes, offset)
+	name, offsetName, err := ExtractName(messageBytes, offset)
 	if err != nil {
 		return -1, err
 	}
@@ -36,8 +37,14 @@ func (question *DNSQuestion) Decode(messageBytes []byte, offset int) (int, error
 	question.Name = name
 
 	//TODO: this logic currently requires specific order and can be error prone
-	question.Type, offset = ReadUint16(messageBytes, offset)
-	question.Class, offset = ReadUint16(messageBytes, offset)
+	question.Type, offset, err = ReadUint16(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read question type: %w", err)
+	}
+	question.Class, offset, err = ReadUint16(messageBytes, offset)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read question class: %w", err)
+	}
 
 	return offset, nil
 }
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import (
 	"github.com/stretchr/testify/assert"
@@ -7,7 +7,7 @@ import (
 
 func TestDNSQuestionWithNameEncoding(t *testing.T) {
 
-	testName := nameEncoder("1")
+	testName := EncodeName("1")
 
 	question := DNSQuestion{
 		Name: testName,
@@ -66,7 +66,7 @@ func TestDNSQuestionWithStaticVariablesEncode(t *testing.T) {
 
 func TestDNSQuestionEncodeDecode(t *testing.T) {
 	question := DNSQuestion{
-		Name:  nameEncoder("mfranc.com"),
+		Name:  EncodeName("mfranc.com"),
 		Type:  1,
 		Class: 5,
 	}
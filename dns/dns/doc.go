@@ -0,0 +1,15 @@
+// Package dns is a DNS message codec (RFC 1035 wire format with name compression, EDNS(0) and typed rdata)
+// and a server answering queries over UDP and TCP with a pluggable Handler
+//
+// Decoding a message
+//
+//	message := dns.DNSMessage{}
+//	err := message.Decode(packet)
+//
+// Running a server in process - with port 0 UDP and TCP listen on the same random port, see Server.LocalAddrs
+//
+//	server := &dns.Server{Addrs: []string{"127.0.0.1:0"}, Handler: dns.LocalHandler{}}
+//	err := server.Listen()
+//	go server.Serve()
+//	defer server.Shutdown(ctx)
+package dns
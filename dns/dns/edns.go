@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// https://www.rfc-editor.org/rfc/rfc6891 - EDNS(0)
+// OPT is a pseudo record that lives in the additional section and reuses the resource record fields
+// - Name is always root
+// - Class is the UDP payload size sender can receive
+// - TTL is split into extended rcode (8 bits), version (8 bits), DO bit and 15 bits of zeros
+// - Data is a list of options code | length | value
+const TypeOPT uint16 = 41
+
+const (
+	// without EDNS the message over UDP can't be bigger than 512 bytes
+	DefaultUDPPayloadSize = 512
+	// payload size this server advertises and the biggest UDP message it will read
+	EDNSUDPPayloadSize = 4096
+)
+
+// rcode 16 is only possible with EDNS as it needs the extended rcode bits
+const RcodeBadVersion uint16 = 16
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+type OPTRecord struct {
+	UDPPayloadSize uint16
+	// upper 8 bits of the 12 bit rcode - lower 4 bits are in the header
+	ExtendedRcode uint8
+	Version       uint8
+	// DNSSEC OK
+	DO      bool
+	Options []EDNSOption
+}
+
+func (opt *OPTRecord) ToAnswer() (DNSAnswer, error) {
+	buf := new(bytes.Buffer)
+	for _, option := range opt.Options {
+		if err := binary.Write(buf, binary.BigEndian, option.Code); err != nil {
+			return DNSAnswer{}, err
+		}
+		if err := binary.Write(buf, binary.BigEndian, uint16(len(option.Data))); err != nil {
+			return DNSAnswer{}, err
+		}
+		buf.Write(option.Data)
+	}
+
+	ttl := uint32(opt.ExtendedRcode)<<24 | uint32(opt.Version)<<16
+	if opt.DO {
+		ttl |= 1 << 15
+	}
+
+	return DNSAnswer{
+		Name:   EncodeName(""),
+		Type:   TypeOPT,
+		Class:  opt.UDPPayloadSize,
+		TTL:    ttl,
+		Length: uint16(buf.Len()),
+		Data:   buf.Bytes(),
+	}, nil
+}
+
+func optFromAnswer(answer DNSAnswer) (*OPTRecord, error) {
+	if answer.Type != TypeOPT {
+		return nil, fmt.Errorf("record of type %d is not OPT", answer.Type)
+	}
+	if !bytes.Equal(answer.Name, []byte{0x00}) {
+		return nil, fmt.Errorf("OPT record has to be owned by root name")
+	}
+
+	opt := &OPTRecord{
+		UDPPayloadSize: answer.Class,
+		ExtendedRcode:  uint8(answer.TTL >> 24),
+		Version:        uint8(answer.TTL >> 16),
+		DO:             answer.TTL&(1<<15) > 0,
+	}
+
+	for offset := 0; offset < len(answer.Data); {
+		option := EDNSOption{}
+		var length uint16
+		var err error
+		option.Code, offset, err = ReadUint16(answer.Data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OPT option code: %w", err)
+		}
+		length, offset, err = ReadUint16(answer.Data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OPT option length: %w", err)
+		}
+		if offset+int(length) > len(answer.Data) {
+			return nil, fmt.Errorf("OPT option %d length %d runs past rdata: %w", option.Code, length, ErrTruncated)
+		}
+		option.Data = append([]byte{}, answer.Data[offset:offset+int(length)]...)
+		offset += int(length)
+		opt.Options = append(opt.Options, option)
+	}
+
+	return opt, nil
+}
+
+// OPT returns EDNS record from the additional section or nil if sender doesn't support EDNS
+func (message *DNSMessage) OPT() (*OPTRecord, error) {
+	for _, record := range message.Additional {
+		if record.Type == TypeOPT {
+			return optFromAnswer(record)
+		}
+	}
+	return nil, nil
+}
+
+// SetOPT replaces OPT record in additional section, nil just removes it
+// header counts are not touched - same as with other sections its up to the caller
+func (message *DNSMessage) SetOPT(opt *OPTRecord) error {
+	var additional []DNSAnswer
+	for _, record := range message.Additional {
+		if record.Type != TypeOPT {
+			additional = append(additional, record)
+		}
+	}
+
+	if opt != nil {
+		record, err := opt.ToAnswer()
+		if err != nil {
+			return err
+		}
+		additional = append(additional, record)
+	}
+
+	message.Additional = additional
+	return nil
+}
+
+// Rcode is the full 12 bit response code - header 4 bits extended by OPT if present
+func (message *DNSMessage) Rcode() uint16 {
+	rcode := message.Header.FLAGS.GetRcode()
+	opt, err := message.OPT()
+	if err == nil && opt != nil {
+		rcode |= uint16(opt.ExtendedRcode) << 4
+	}
+	return rcode
+}
+
+// UDPPayloadSize returns the biggest response sender of the message can receive over UDP
+// it's what the client advertised in OPT but never less than 512 and never more than this server supports
+func (message *DNSMessage) UDPPayloadSize() int {
+	opt, err := message.OPT()
+	if err != nil || opt == nil {
+		return DefaultUDPPayloadSize
+	}
+
+	size := int(opt.UDPPayloadSize)
+	if size < DefaultUDPPayloadSize {
+		return DefaultUDPPayloadSize
+	}
+	if size > EDNSUDPPayloadSize {
+		return EDNSUDPPayloadSize
+	}
+	return size
+}
+
+// validates OPT placement after decoding - https://www.rfc-editor.org/rfc/rfc6891#section-6.1.1
+// there can be only one OPT and only in the additional section
+func validateOPT(message *DNSMessage) error {
+	for _, section := range [][]DNSAnswer{message.Answers, message.Authority} {
+		for _, record := range section {
+			if record.Type == TypeOPT {
+				return fmt.Errorf("OPT record outside of additional section")
+			}
+		}
+	}
+
+	found := 0
+	for _, record := range message.Additional {
+		if record.Type != TypeOPT {
+			continue
+		}
+		found++
+		if _, err := optFromAnswer(record); err != nil {
+			return err
+		}
+	}
+	if found > 1 {
+		return fmt.Errorf("message has %d OPT records only one is allowed", found)
+	}
+
+	return nil
+}
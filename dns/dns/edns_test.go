@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOPTRecordEncodeDecode(t *testing.T) {
+	opt := &OPTRecord{
+		UDPPayloadSize: 1232,
+		ExtendedRcode:  1,
+		Version:        0,
+		DO:             true,
+		Options: []EDNSOption{
+			{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, // cookie
+			{Code: 12, Data: []byte{}},                       // padding
+		},
+	}
+
+	answer, err := opt.ToAnswer()
+	assert.NoError(t, err)
+	assert.Equal(t, TypeOPT, answer.Type)
+	assert.Equal(t, uint16(1232), answer.Class)
+	// extended rcode 1 in top byte and DO bit
+	assert.Equal(t, uint32(0x01008000), answer.TTL)
+
+	decoded, err := optFromAnswer(answer)
+	assert.NoError(t, err)
+	assert.Equal(t, opt, decoded)
+}
+
+func TestOPTRecordInvalidOptions(t *testing.T) {
+	answer := DNSAnswer{
+		Name:   []byte{0x00},
+		Type:   TypeOPT,
+		Class:  512,
+		Length: 5,
+		// option says 4 bytes of data but only 1 follows
+		Data: []byte{0, 10, 0, 4, 1},
+	}
+
+	_, err := optFromAnswer(answer)
+	assert.Error(t, err)
+
+	answer = DNSAnswer{Name: EncodeName("example.com"), Type: TypeOPT}
+	_, err = optFromAnswer(answer)
+	assert.Error(t, err)
+}
+
+func TestDNSMessageOPT(t *testing.T) {
+	message := DNSMessage{
+		Header: DNSHeader{ID: 1, QDCOUNT: 1},
+		Questions: []DNSQuestion{
+			{Name: EncodeName("mfranc.com"), Type: TypeA, Class: ClassIN},
+		},
+	}
+
+	opt, err := message.OPT()
+	assert.NoError(t, err)
+	assert.Nil(t, opt)
+	assert.Equal(t, 512, message.UDPPayloadSize())
+
+	err = message.SetOPT(&OPTRecord{UDPPayloadSize: 1232, DO: true})
+	assert.NoError(t, err)
+	message.Header.ARCOUNT = uint16(len(message.Additional))
+
+	encoded, err := message.Encode()
+	assert.NoError(t, err)
+
+	decoded := DNSMessage{}
+	err = decoded.Decode(encoded)
+	assert.NoError(t, err)
+
+	opt, err = decoded.OPT()
+	assert.NoError(t, err)
+	assert.Equal(t, &OPTRecord{UDPPayloadSize: 1232, DO: true}, opt)
+	assert.Equal(t, 1232, decoded.UDPPayloadSize())
+
+	// setting OPT again replaces the old one
+	err = decoded.SetOPT(&OPTRecord{UDPPayloadSize: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(decoded.Additional))
+	// less than 512 is treated as 512
+	assert.Equal(t, 512, decoded.UDPPayloadSize())
+
+	err = decoded.SetOPT(&OPTRecord{UDPPayloadSize: 65000})
+	assert.NoError(t, err)
+	assert.Equal(t, EDNSUDPPayloadSize, decoded.UDPPayloadSize())
+
+	err = decoded.SetOPT(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(decoded.Additional))
+}
+
+func TestDNSMessageRcodeWithOPT(t *testing.T) {
+	message := DNSMessage{}
+	err := message.Header.FLAGS.SetRcode(0)
+	assert.NoError(t, err)
+
+	err = message.SetOPT(&OPTRecord{ExtendedRcode: 1})
+	assert.NoError(t, err)
+
+	// BADVERS is 16 - 1 in extended rcode and 0 in the header
+	assert.Equal(t, RcodeBadVersion, message.Rcode())
+}
+
+func TestDecodeDNSMessageWithTwoOPT(t *testing.T) {
+	opt, err := (&OPTRecord{UDPPayloadSize: 1232}).ToAnswer()
+	assert.NoError(t, err)
+
+	message := DNSMessage{
+		Header:     DNSHeader{ARCOUNT: 2},
+		Additional: []DNSAnswer{opt, opt},
+	}
+
+	encoded, err := message.Encode()
+	assert.NoError(t, err)
+
+	err = (&DNSMessage{}).Decode(encoded)
+	assert.Error(t, err)
+}
@@ -0,0 +1,18 @@
+package dns
+
+import "errors"
+
+// Decoding errors - all of them mean the message is malformed and the server should answer FORMERR
+// they are wrapped with more context on the way up so use errors.Is to check for them
+var (
+	// message ends before the field we are reading
+	ErrTruncated = errors.New("message truncated")
+	// compression pointer leads back to a place we already visited
+	ErrPointerLoop = errors.New("compression pointer loop")
+	// labels can be at most 63 bytes - https://www.rfc-editor.org/rfc/rfc1035#section-2.3.4
+	ErrLabelTooLong = errors.New("label longer than 63 bytes")
+	// whole name can be at most 255 bytes
+	ErrNameTooLong = errors.New("name longer than 255 bytes")
+	// compression pointer can only point to data that was already seen earlier in the message
+	ErrForwardPointer = errors.New("compression pointer points forward")
+)
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errResolverServerFailure = errors.New("resolver answered SERVFAIL")
+
+// how long client waits for resolver when there is stale answer to give it instead
+// clients give up after a few seconds and the upstream retries take longer than that
+// https://www.rfc-editor.org/rfc/rfc8767#section-5 suggests 1.8s
+const clientResponseTimeout = 1800 * time.Millisecond
+
+// LocalHandler answers without any resolver - every question gets the same static A record
+type LocalHandler struct{}
+
+func (LocalHandler) ServeDNS(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+	answers, err := generateLocalResponse(*req)
+	if err != nil {
+		fmt.Printf("Error when reaching local dns cache: %v\n", err)
+		return
+	}
+
+	response := NewResponse(req)
+	response.Answers = answers
+	writeResponse(w, response)
+}
+
+// ForwardingHandler sends every question to the resolver and passes its answer back to the client
+// identical questions asked at the same time share one query to resolver
+type ForwardingHandler struct {
+	resolver Resolver
+	// answers are kept here when it's set - can be changed only before the first query
+	Cache *Cache
+
+	flights coalescer
+	// see clientResponseTimeout
+	staleTimeout time.Duration
+}
+
+// NewForwardingHandler creates handler asking the resolver - single Upstream or UpstreamPool
+func NewForwardingHandler(resolver Resolver) *ForwardingHandler {
+	return &ForwardingHandler{resolver: resolver, staleTimeout: clientResponseTimeout}
+}
+
+func (h *ForwardingHandler) ServeDNS(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+	resolved, err := h.contactResolver(ctx, *req)
+	if err != nil {
+		// nothing written so the server answers SERVFAIL
+		fmt.Printf("Error when contacting resolver: %v\n", err)
+		return
+	}
+
+	response := NewResponse(req)
+	response.Answers = resolved.Answers
+	response.Authority = resolved.Authority
+	response.Additional = resolved.Additional
+	// rcode from resolver always fits as it was read from a header
+	_ = response.Header.FLAGS.SetRcode(resolved.Header.FLAGS.GetRcode())
+	// resolver couldn't give us the full answer so the client should know it's not complete
+	response.Header.FLAGS.SetTC(resolved.Header.FLAGS.GetTC())
+	writeResponse(w, response)
+}
+
+// returns a message holding only the answer, authority and additional records collected from resolver
+// for all the questions - header and questions are built by the caller
+// TC is set on it when resolver answer was truncated and couldn't be fetched over TCP either
+func (h *ForwardingHandler) contactResolver(ctx context.Context, receivedMessage DNSMessage) (DNSMessage, error) {
+	var resolved DNSMessage
+	for _, questionReceived := range receivedMessage.Questions {
+		newMessageToResolver := DNSMessage{
+			Header:    receivedMessage.Header,
+			Questions: []DNSQuestion{questionReceived},
+		}
+
+		// We can only send one question at a time to resolver
+		// Actually apparently this feature to sent multiple questions in one DNS query is not really used
+		newMessageToResolver.Header.QDCOUNT = 1
+		newMessageToResolver.Header.ANCOUNT = 0
+		newMessageToResolver.Header.NSCOUNT = 0
+		newMessageToResolver.Header.ARCOUNT = 0
+
+		// if client talks EDNS we talk EDNS to the resolver with our own OPT - it's hop by hop so client options
+		// (cookies, client subnet) are not passed on, only DO is as it decides if the answer comes with signatures
+		// we advertise our own payload size - response is truncated to what the client can receive when we answer it
+		requestOPT, err := receivedMessage.OPT()
+		if err != nil {
+			return resolved, fmt.Errorf("failed to read OPT from query: %w", err)
+		}
+		if requestOPT != nil {
+			err = newMessageToResolver.SetOPT(&OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize, DO: requestOPT.DO})
+			if err != nil {
+				return resolved, fmt.Errorf("failed to set OPT on query to resolver: %w", err)
+			}
+			newMessageToResolver.Header.ARCOUNT = uint16(len(newMessageToResolver.Additional))
+		}
+
+		responseFromeResolver, err := h.exchange(ctx, newMessageToResolver)
+		if err != nil {
+			return resolved, err
+		}
+
+		// NXDOMAIN, SERVFAIL or REFUSED from resolver are passed to the client as they are
+		// with multiple questions first failure wins
+		if resolved.Header.FLAGS.GetRcode() == RcodeSuccess {
+			err = resolved.Header.FLAGS.SetRcode(responseFromeResolver.Header.FLAGS.GetRcode())
+			if err != nil {
+				return resolved, fmt.Errorf("failed to set rcode from resolver: %w", err)
+			}
+		}
+
+		if responseFromeResolver.Header.FLAGS.GetTC() {
+			resolved.Header.FLAGS.SetTC(true)
+		}
+
+		// authority carries referrals and SOA for negative answers and additional carries glue
+		// so we keep all of them and not only the answers
+		resolved.Answers = append(resolved.Answers, responseFromeResolver.Answers...)
+		resolved.Authority = append(resolved.Authority, responseFromeResolver.Authority...)
+		resolved.Additional = append(resolved.Additional, responseFromeResolver.Additional...)
+	}
+	return resolved, nil
+}
+
+// answer for a single question - from cache when it's there, otherwise from resolver
+// when resolver fails or is slow the last answer it gave is served stale if the cache still has it
+func (h *ForwardingHandler) exchange(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	if h.Cache != nil {
+		cached, state := h.Cache.lookup(query)
+		switch state {
+		case cacheFresh:
+			return cached, nil
+		case cacheRefresh:
+			// client gets what we have and the next ones get the new answer before this one expires
+			// client context is not used as it's cancelled as soon as we answer
+			go h.refresh(context.WithoutCancel(ctx), query)
+			return cached, nil
+		}
+
+		if stale, ok := h.Cache.GetStale(query); ok {
+			return h.resolveOrServeStale(ctx, query, stale)
+		}
+	}
+
+	return h.resolve(ctx, query)
+}
+
+// resolver gets staleTimeout to answer - after that the client gets the stale answer
+// and the query goes on in the background so its answer replaces the stale one in cache
+func (h *ForwardingHandler) resolveOrServeStale(ctx context.Context, query DNSMessage, stale DNSMessage) (DNSMessage, error) {
+	type result struct {
+		response DNSMessage
+		err      error
+	}
+	// buffered so the query can finish when nobody waits for it anymore
+	results := make(chan result, 1)
+	go func() {
+		response, err := h.resolve(context.WithoutCancel(ctx), query)
+		results <- result{response, err}
+	}()
+
+	timer := time.NewTimer(h.staleTimeout)
+	defer timer.Stop()
+
+	name := DecodeName(query.Questions[0].Name)
+	select {
+	case result := <-results:
+		// SERVFAIL means resolver couldn't get the answer either - https://www.rfc-editor.org/rfc/rfc8767#section-5
+		if result.err == nil && result.response.Header.FLAGS.GetRcode() != RcodeServerFailure {
+			return result.response, nil
+		}
+		fmt.Printf("Serving stale answer for %s: resolver failed: %v\n", name, cmp.Or(result.err, errResolverServerFailure))
+	case <-timer.C:
+		fmt.Printf("Serving stale answer for %s: resolver didn't answer in %v\n", name, h.staleTimeout)
+	case <-ctx.Done():
+		return DNSMessage{}, ctx.Err()
+	}
+	return stale, nil
+}
+
+// asks resolver unless the same question is already asked - then waits for that answer instead
+// answer is cached once by whoever asked and comes without OPT (same as from cache)
+// as OPT is hop by hop and the answer is shared by all the callers
+func (h *ForwardingHandler) resolve(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	return h.flights.do(ctx, query, func() (DNSMessage, error) {
+		response, err := h.resolver.Exchange(ctx, query)
+		if err != nil {
+			return response, err
+		}
+		if h.Cache != nil {
+			h.Cache.Set(query, response)
+		}
+		response.Additional = withoutOPT(response.Additional)
+		response.Header.ARCOUNT = uint16(len(response.Additional))
+		return response, nil
+	})
+}
+
+// fetches the answer again so it's replaced in cache before it expires
+func (h *ForwardingHandler) refresh(ctx context.Context, query DNSMessage) {
+	_, err := h.resolve(ctx, query)
+	if err != nil {
+		// cached answer expires as usual and the next query asks resolver again
+		fmt.Printf("Error when refreshing cached answer: %v\n", err)
+	}
+}
+
+// Stats tells how many questions were sent to resolver and how many of them waited
+// for the same question in progress instead
+func (h *ForwardingHandler) Stats() ForwardingStats {
+	return ForwardingStats{
+		UpstreamQueries:  h.flights.started.Load(),
+		CoalescedQueries: h.flights.coalesced.Load(),
+	}
+}
+
+func generateLocalResponse(receivedMessage DNSMessage) ([]DNSAnswer, error) {
+	// This returns static message
+	var answers []DNSAnswer
+
+	ipEncoded, err := EncodeIPv4("8.8.8.8")
+	if err != nil {
+		fmt.Println("Couldnt encode answer data:", err)
+	}
+
+	for _, questionReceived := range receivedMessage.Questions {
+		answers = append(answers, DNSAnswer{
+			Name:   questionReceived.Name,
+			Class:  1,
+			Type:   1,
+			TTL:    60,
+			Length: 4,
+			Data:   ipEncoded,
+		})
+	}
+
+	return answers, nil
+}
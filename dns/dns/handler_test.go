@@ -0,0 +1,415 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardingHandlerServerFailure(t *testing.T) {
+	// resolver that never answers
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage { return nil })
+	upstream.Retry = RetryPolicy{Attempts: 2, AttemptTimeout: 50 * time.Millisecond, MaxAttemptTimeout: time.Second}
+
+	query := newTestQuery(t, nil)
+
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), NewForwardingHandler(upstream), encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, query.Header.ID, decoded.Header.ID)
+	assert.Equal(t, RcodeServerFailure, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, query.Questions, decoded.Questions)
+	assert.Equal(t, 0, len(decoded.Answers))
+}
+
+func TestForwardingHandlerPassesResolverRcode(t *testing.T) {
+	soa, err := NewAnswer("mfranc.com", ClassIN, 300, &RDataSOA{MName: "ns1.mfranc.com", RName: "admin.mfranc.com", Minimum: 300})
+	assert.NoError(t, err)
+
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		response.Header.NSCOUNT = 1
+		response.Authority = []DNSAnswer{soa}
+		_ = response.Header.FLAGS.SetRcode(RcodeNameError)
+		return response
+	})
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), NewForwardingHandler(upstream), encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeNameError, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, []DNSAnswer{soa}, decoded.Authority)
+}
+
+// resolver answer didn't fit into UDP and resolver doesn't talk TCP - client gets TC and can retry over TCP with us
+func TestForwardingHandlerPassesResolverTruncation(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		response.Header.FLAGS.SetTC(true)
+		return response
+	})
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), NewForwardingHandler(upstream), encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.True(t, decoded.Header.FLAGS.GetTC())
+}
+
+// the same question asked twice reaches resolver once and the second answer has TTL from cache
+func TestForwardingHandlerUsesCache(t *testing.T) {
+	var queries atomic.Int32
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	cache, now := newTestCache(10)
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = cache
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, uint32(60), decoded.Answers[0].TTL)
+
+	*now = now.Add(10 * time.Second)
+	query.Header.ID = 4321
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, uint16(4321), decoded.Header.ID)
+	assert.Equal(t, uint32(50), decoded.Answers[0].TTL)
+	assert.Equal(t, int32(1), queries.Load())
+}
+
+// second NXDOMAIN comes from cache with SOA in authority
+func TestForwardingHandlerCachesNegativeAnswers(t *testing.T) {
+	soa, err := NewAnswer("mfranc.com", ClassIN, 3600, &RDataSOA{MName: "ns1.mfranc.com", RName: "admin.mfranc.com", Minimum: 300})
+	assert.NoError(t, err)
+
+	var queries atomic.Int32
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		response := newTestResponse(query)
+		response.Header.NSCOUNT = 1
+		response.Authority = []DNSAnswer{soa}
+		_ = response.Header.FLAGS.SetRcode(RcodeNameError)
+		return response
+	})
+
+	cache, now := newTestCache(10)
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = cache
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeNameError, decoded.Header.FLAGS.GetRcode())
+
+	*now = now.Add(100 * time.Second)
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeNameError, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, 1, len(decoded.Authority))
+	assert.Equal(t, uint32(200), decoded.Authority[0].TTL)
+	assert.Equal(t, int32(1), queries.Load())
+}
+
+func TestForwardingHandlerServesStale(t *testing.T) {
+	var failing atomic.Bool
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		if failing.Load() {
+			_ = response.Header.FLAGS.SetRcode(RcodeServerFailure)
+			return response
+		}
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	cache, now := newTestCache(10)
+	cache.MaxStale = time.Hour
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = cache
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, uint32(60), decoded.Answers[0].TTL)
+
+	failing.Store(true)
+	*now = now.Add(10 * time.Minute)
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, uint32(30), decoded.Answers[0].TTL)
+
+	// too old even to be served stale
+	*now = now.Add(time.Hour)
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeServerFailure, decoded.Header.FLAGS.GetRcode())
+}
+
+// client doesn't wait for slow resolver longer than staleTimeout when there is stale answer
+// and the answer that comes later replaces the stale one in cache
+func TestForwardingHandlerServesStaleWhenResolverIsSlow(t *testing.T) {
+	var slow atomic.Bool
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		last := byte(1)
+		if slow.Load() {
+			<-release
+			last = 2
+		}
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, last)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	cache, now := newTestCache(10)
+	cache.MaxStale = time.Hour
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = cache
+	handler.staleTimeout = 50 * time.Millisecond
+
+	query := newTestQuery(t, nil)
+	handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil)
+
+	slow.Store(true)
+	*now = now.Add(10 * time.Minute)
+	started := time.Now()
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Less(t, time.Since(started), 500*time.Millisecond)
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, uint32(30), decoded.Answers[0].TTL)
+	rdata, err := decoded.Answers[0].RData()
+	assert.NoError(t, err)
+	assert.Equal(t, &RDataA{IP: net.IPv4(10, 0, 0, 1).To4()}, rdata)
+
+	// query to resolver went on after the client got the stale answer
+	close(release)
+	assert.Eventually(t, func() bool {
+		cached, ok := cache.Get(DNSMessage{Questions: query.Questions})
+		if !ok {
+			return false
+		}
+		rdata, err := cached.Answers[0].RData()
+		return err == nil && rdata.(*RDataA).IP.Equal(net.IPv4(10, 0, 0, 2))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestForwardingHandlerRefreshesPopularAnswers(t *testing.T) {
+	var queries atomic.Int32
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 100, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	cache, now := newTestCache(10)
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = cache
+
+	query := newTestQuery(t, nil)
+	for range refreshHits {
+		handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil)
+	}
+	assert.Equal(t, int32(1), queries.Load())
+
+	*now = now.Add(95 * time.Second)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, uint32(5), decoded.Answers[0].TTL)
+
+	// answer is replaced in the background
+	assert.Eventually(t, func() bool {
+		cached, ok := cache.Get(DNSMessage{Questions: query.Questions})
+		return ok && cached.Answers[0].TTL == 100
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), queries.Load())
+}
+
+func TestForwardingHandlerCoalescesQueries(t *testing.T) {
+	var queries atomic.Int32
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		<-release
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+	handler := NewForwardingHandler(upstream)
+
+	const clients = 10
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := newTestQuery(t, nil)
+			query.Header.ID = uint16(i)
+			decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+			assert.Equal(t, uint16(i), decoded.Header.ID)
+			assert.Len(t, decoded.Answers, 1)
+		}()
+	}
+
+	assert.Eventually(t, func() bool {
+		stats := handler.Stats()
+		return stats.UpstreamQueries+stats.CoalescedQueries == clients
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), queries.Load())
+	assert.Equal(t, ForwardingStats{UpstreamQueries: 1, CoalescedQueries: clients - 1}, handler.Stats())
+}
+
+// every caller waiting for the same EDNS query gets the answer without resolver's OPT but with the other records
+func TestForwardingHandlerCoalescedAnswerWithoutOPT(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		<-release
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataNS{Host: "ns1.mfranc.com"})
+		glue, _ := NewAnswer("ns1.mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Additional = []DNSAnswer{glue}
+		_ = response.SetOPT(&OPTRecord{UDPPayloadSize: 1232, Options: []EDNSOption{{Code: 10, Data: []byte("resolver")}}})
+		response.Header.ANCOUNT = 1
+		response.Header.ARCOUNT = uint16(len(response.Additional))
+		return response
+	})
+	handler := NewForwardingHandler(upstream)
+
+	const clients = 5
+	responses := make(chan DNSMessage, clients)
+	for range clients {
+		go func() {
+			query := newTestQuery(t, &OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize, DO: true})
+			query.Questions[0].Type = TypeNS
+			response, err := handler.resolve(context.Background(), query)
+			assert.NoError(t, err)
+			responses <- response
+		}()
+	}
+
+	assert.Eventually(t, func() bool {
+		stats := handler.Stats()
+		return stats.UpstreamQueries+stats.CoalescedQueries == clients
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	for range clients {
+		response := <-responses
+		opt, err := response.OPT()
+		assert.NoError(t, err)
+		assert.Nil(t, opt)
+		assert.Len(t, response.Additional, 1)
+		assert.Equal(t, uint16(1), response.Header.ARCOUNT)
+	}
+	assert.Equal(t, ForwardingStats{UpstreamQueries: 1, CoalescedQueries: clients - 1}, handler.Stats())
+}
+
+// EDNS options are hop by hop - one client's cookie must never reach the resolver or the other client
+func TestForwardingHandlerDoesNotPassEDNSOptions(t *testing.T) {
+	release := make(chan struct{})
+	var forwarded atomic.Value
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		<-release
+		opt, _ := query.OPT()
+		forwarded.Store(opt)
+
+		// resolver sends its own cookie back
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		_ = response.SetOPT(&OPTRecord{UDPPayloadSize: 1232, Options: []EDNSOption{{Code: 10, Data: []byte("resolver")}}})
+		response.Header.ARCOUNT = uint16(len(response.Additional))
+		return response
+	})
+	handler := NewForwardingHandler(upstream)
+
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cookie := []byte(fmt.Sprintf("client-%d", i))
+			query := newTestQuery(t, &OPTRecord{UDPPayloadSize: 1232, DO: true, Options: []EDNSOption{{Code: 10, Data: cookie}}})
+			decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+			assert.Len(t, decoded.Answers, 1)
+
+			opt, err := decoded.OPT()
+			assert.NoError(t, err)
+			assert.Equal(t, &OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize, DO: true}, opt)
+		}()
+	}
+
+	// both clients wait for the same query
+	assert.Eventually(t, func() bool {
+		stats := handler.Stats()
+		return stats.UpstreamQueries+stats.CoalescedQueries == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, &OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize, DO: true}, forwarded.Load())
+	assert.Equal(t, ForwardingStats{UpstreamQueries: 1, CoalescedQueries: 1}, handler.Stats())
+}
+
+// DO and CD go to resolver so its answers to them are cached and coalesced apart from the plain ones
+func TestForwardingHandlerKeepsDNSSECQueriesApart(t *testing.T) {
+	var queries atomic.Int32
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		// last byte of the address tells which flags the resolver got
+		last := byte(1)
+		if opt, _ := query.OPT(); opt != nil && opt.DO {
+			last++
+		}
+		if query.Header.FLAGS.GetCD() {
+			last += 2
+		}
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, last)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+	handler := NewForwardingHandler(upstream)
+	handler.Cache = NewCache(10)
+
+	tests := []struct {
+		do, cd bool
+		ip     net.IP
+	}{
+		{false, false, net.IPv4(10, 0, 0, 1)},
+		{true, false, net.IPv4(10, 0, 0, 2)},
+		{false, true, net.IPv4(10, 0, 0, 3)},
+		{true, true, net.IPv4(10, 0, 0, 4)},
+	}
+	// second round is answered from cache
+	for range 2 {
+		for _, test := range tests {
+			query := newTestQuery(t, &OPTRecord{UDPPayloadSize: 1232, DO: test.do})
+			query.Header.FLAGS.SetCD(test.cd)
+			decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+
+			rdata, err := decoded.Answers[0].RData()
+			assert.NoError(t, err)
+			assert.Equal(t, &RDataA{IP: test.ip.To4()}, rdata, "DO: %t CD: %t", test.do, test.cd)
+		}
+	}
+	assert.Equal(t, int32(4), queries.Load())
+}
@@ -0,0 +1,32 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+func ReadUint16(data []byte, offset int) (uint16, int, error) {
+	uint16ByteSize := 2
+
+	if offset < 0 || offset+uint16ByteSize > len(data) {
+		return 0, -1, fmt.Errorf("reading uint16 at offset %d from %d bytes: %w", offset, len(data), ErrTruncated)
+	}
+
+	v := binary.BigEndian.Uint16(data[offset : offset+uint16ByteSize])
+	offset += uint16ByteSize
+
+	return v, offset, nil
+}
+
+func ReadUint32(data []byte, offset int) (uint32, int, error) {
+	uint32ByteSize := 4
+
+	if offset < 0 || offset+uint32ByteSize > len(data) {
+		return 0, -1, fmt.Errorf("reading uint32 at offset %d from %d bytes: %w", offset, len(data), ErrTruncated)
+	}
+
+	v := binary.BigEndian.Uint32(data[offset : offset+uint32ByteSize])
+	offset += uint32ByteSize
+
+	return v, offset, nil
+}
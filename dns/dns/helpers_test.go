@@ -0,0 +1,30 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUint16(t *testing.T) {
+	value, offset, err := ReadUint16([]byte{0x01, 0x02, 0x03}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x0203), value)
+	assert.Equal(t, 3, offset)
+
+	_, _, err = ReadUint16([]byte{0x01, 0x02, 0x03}, 2)
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	_, _, err = ReadUint16([]byte{}, 0)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestReadUint32(t *testing.T) {
+	value, offset, err := ReadUint32([]byte{0x00, 0x00, 0x01, 0x00}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(256), value)
+	assert.Equal(t, 4, offset)
+
+	_, _, err = ReadUint32([]byte{0x00, 0x00, 0x01, 0x00}, 1)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
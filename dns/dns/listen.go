@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// used when no --listen flag is given
+const defaultListenAddress = "127.0.0.1:2053"
+
+// how many random ports are tried when UDP got a port that is taken for TCP
+const randomPortAttempts = 10
+
+// Address from the --listen flag
+//   - `127.0.0.1:2053` or `[::1]:53` - listens on UDP and TCP
+//   - `[::]:53` - on Linux it's dual-stack and accepts IPv4 clients as well
+//   - `udp://127.0.0.1:2053` - only one network, udp4/udp6/tcp4/tcp6 restrict it to one IP version
+//     so `udp6://[::]:53` is IPv6 only
+type listenAddress struct {
+	// empty means both UDP and TCP
+	network string
+	address string
+}
+
+func parseListenAddress(value string) (listenAddress, error) {
+	listen := listenAddress{address: value}
+
+	if network, address, found := strings.Cut(value, "://"); found {
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return listenAddress{}, fmt.Errorf("unsupported network %q in listen address %q", network, value)
+		}
+		listen = listenAddress{network: network, address: address}
+	}
+
+	// port has to be given explicitly - 0 picks a random one (shared by UDP and TCP, see openUDPAndTCP)
+	_, port, err := net.SplitHostPort(listen.address)
+	if err != nil {
+		return listenAddress{}, fmt.Errorf("invalid listen address %q: %w", value, err)
+	}
+	if port == "" {
+		return listenAddress{}, fmt.Errorf("listen address %q is missing port", value)
+	}
+
+	return listen, nil
+}
+
+func (l listenAddress) String() string {
+	if l.network == "" {
+		return l.address
+	}
+	return l.network + "://" + l.address
+}
+
+// sockets opened for all the --listen addresses - all of them are served by the same handler
+type listeners struct {
+	udp []*net.UDPConn
+	tcp []net.Listener
+}
+
+// opens everything or nothing - when one of the addresses fails the ones already opened are closed
+func openListeners(addresses []listenAddress) (*listeners, error) {
+	opened := &listeners{}
+
+	for _, listen := range addresses {
+		var err error
+		if listen.network == "" {
+			err = opened.openUDPAndTCP(listen.address)
+		} else {
+			err = opened.open(listen.network, listen.address)
+		}
+		if err != nil {
+			closeErr := opened.Close()
+			return nil, errors.Join(fmt.Errorf("failed to listen on %s: %w", listen, err), closeErr)
+		}
+	}
+
+	return opened, nil
+}
+
+// UDP first and TCP on the port UDP got - with port 0 each of them would get a different random one
+// and client retrying truncated answer over TCP expects the same port
+func (l *listeners) openUDPAndTCP(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	for range randomPortAttempts {
+		err = l.open("udp", address)
+		if err != nil {
+			return err
+		}
+		udpConn := l.udp[len(l.udp)-1]
+
+		tcpPort := strconv.Itoa(udpConn.LocalAddr().(*net.UDPAddr).Port)
+		err = l.open("tcp", net.JoinHostPort(host, tcpPort))
+		if err == nil || port != "0" {
+			// UDP socket of the failed pair is closed with the others by openListeners
+			return err
+		}
+
+		// port is free for UDP but taken for TCP - try another one
+		_ = udpConn.Close()
+		l.udp = l.udp[:len(l.udp)-1]
+	}
+	return err
+}
+
+func (l *listeners) open(network string, address string) error {
+	if strings.HasPrefix(network, "udp") {
+		udpAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return err
+		}
+		udpConn, err := net.ListenUDP(network, udpAddr)
+		if err != nil {
+			return err
+		}
+		l.udp = append(l.udp, udpConn)
+		return nil
+	}
+
+	tcpListener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	l.tcp = append(l.tcp, tcpListener)
+	return nil
+}
+
+// closing sockets is what makes serveUDP and serveTCP return
+func (l *listeners) Close() error {
+	var errs []error
+	for _, udpConn := range l.udp {
+		errs = append(errs, udpConn.Close())
+	}
+	for _, tcpListener := range l.tcp {
+		errs = append(errs, tcpListener.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected listenAddress
+	}{
+		{"127.0.0.1:2053", listenAddress{address: "127.0.0.1:2053"}},
+		{"[::]:53", listenAddress{address: "[::]:53"}},
+		{":53", listenAddress{address: ":53"}},
+		{"udp://127.0.0.1:2053", listenAddress{network: "udp", address: "127.0.0.1:2053"}},
+		{"tcp6://[::1]:53", listenAddress{network: "tcp6", address: "[::1]:53"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			listen, err := parseListenAddress(test.value)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, listen)
+			assert.Equal(t, test.value, listen.String())
+		})
+	}
+}
+
+func TestParseListenAddressErrors(t *testing.T) {
+	for _, value := range []string{"127.0.0.1", "127.0.0.1:", "::1:53", "sctp://127.0.0.1:53", "udp://"} {
+		t.Run(value, func(t *testing.T) {
+			_, err := parseListenAddress(value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	opened, err := openListeners([]listenAddress{
+		{address: "127.0.0.1:0"},
+		{network: "udp", address: "127.0.0.1:0"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(opened.udp))
+	assert.Equal(t, 1, len(opened.tcp))
+	assert.NoError(t, opened.Close())
+}
+
+// with port 0 TCP listens on the random port UDP got
+func TestOpenListenersSamePort(t *testing.T) {
+	opened, err := openListeners([]listenAddress{{address: "127.0.0.1:0"}})
+	assert.NoError(t, err)
+	defer opened.Close()
+
+	udpPort := opened.udp[0].LocalAddr().(*net.UDPAddr).Port
+	assert.NotZero(t, udpPort)
+	assert.Equal(t, udpPort, opened.tcp[0].Addr().(*net.TCPAddr).Port)
+}
+
+// second address can't be opened so the first one has to be closed again
+func TestOpenListenersClosesOnError(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer taken.Close()
+
+	_, err = openListeners([]listenAddress{
+		{network: "tcp", address: "127.0.0.1:0"},
+		{network: "udp", address: taken.LocalAddr().String()},
+	})
+	assert.Error(t, err)
+}
+
+// IPv4 client gets an answer from socket listening on [::]
+func TestServeUDPDualStack(t *testing.T) {
+	opened, err := openListeners([]listenAddress{{network: "udp", address: "[::]:0"}})
+	if err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	}
+	assert.NoError(t, opened.Close())
+
+	addrs := startTestServer(t, &Server{Addrs: []string{"udp://[::]:0"}, Handler: LocalHandler{}})
+
+	port := addrs[0].(*net.UDPAddr).Port
+	response := exchangeTestUDP(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, newTestQuery(t, nil))
+	assert.Equal(t, 1, len(response.Answers))
+}
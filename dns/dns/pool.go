@@ -0,0 +1,275 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// upstream that failed that many queries in a row is considered down
+	maxUpstreamFailures = 3
+	// down upstream is skipped for that long, then it gets a query again to see if it recovered
+	// every failure while it's down doubles the time up to maxUpstreamDownTime
+	upstreamDownTime    = 5 * time.Second
+	maxUpstreamDownTime = time.Minute
+	// how many upstreams StrategyRace asks at once when UpstreamPool.Racers is not set
+	defaultRacers = 2
+)
+
+// UpstreamStrategy decides in which order upstreams of the pool are asked
+type UpstreamStrategy int
+
+const (
+	// always the first healthy upstream, the next ones only when it fails
+	StrategyFailover UpstreamStrategy = iota
+	// every query starts with the next upstream
+	StrategyRoundRobin
+	// every query starts with upstream picked at random
+	StrategyRandom
+	// upstream with the lowest smoothed round trip time first
+	StrategyFastest
+	// the fastest upstreams are asked at the same time and the first answer wins - see UpstreamPool.Racers
+	// trades more traffic to resolvers for not waiting on the slow one
+	StrategyRace
+)
+
+var strategyNames = map[UpstreamStrategy]string{
+	StrategyFailover:   "failover",
+	StrategyRoundRobin: "round-robin",
+	StrategyRandom:     "random",
+	StrategyFastest:    "fastest",
+	StrategyRace:       "race",
+}
+
+func (s UpstreamStrategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("UpstreamStrategy(%d)", int(s))
+}
+
+// UnmarshalText accepts the names returned by String so strategy can be given as a flag
+func (s *UpstreamStrategy) UnmarshalText(text []byte) error {
+	for strategy, name := range strategyNames {
+		if name == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown upstream strategy %q, expected one of: failover, round-robin, random, fastest, race", text)
+}
+
+// health of single upstream in the pool
+type poolMember struct {
+	upstream *Upstream
+	// smoothed round trip time of successful queries, 0 until the first one
+	srtt time.Duration
+	// failed queries in a row
+	failures  int
+	downUntil time.Time
+	downTime  time.Duration
+}
+
+// UpstreamPool sends every query to one of many upstreams and to the next ones when it fails
+// upstream that keeps failing is marked down and skipped until it recovers (see maxUpstreamFailures)
+// when all upstreams are down they are still tried - failing query is no worse than no query
+type UpstreamPool struct {
+	strategy UpstreamStrategy
+	// how many upstreams StrategyRace asks at once, 2 when not set
+	// can be changed only before the first Exchange
+	Racers int
+
+	mu      sync.Mutex
+	members []*poolMember
+	// round robin position
+	next uint64
+	now  func() time.Time
+}
+
+// NewUpstreamPool takes over the upstreams - they are closed by Close
+func NewUpstreamPool(strategy UpstreamStrategy, upstreams ...*Upstream) *UpstreamPool {
+	pool := &UpstreamPool{strategy: strategy, now: time.Now}
+	for _, upstream := range upstreams {
+		pool.members = append(pool.members, &poolMember{upstream: upstream})
+	}
+	return pool
+}
+
+// Exchange sends the query to upstreams in the order given by the strategy until one of them answers
+// answer with any rcode counts - SERVFAIL or REFUSED from resolver is still an answer
+// with StrategyRace the query goes to Racers upstreams at once and when all of them fail to the next Racers
+func (p *UpstreamPool) Exchange(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	if len(p.members) == 0 {
+		return DNSMessage{}, errors.New("upstream pool is empty")
+	}
+
+	racers := 1
+	if p.strategy == StrategyRace {
+		racers = cmp.Or(p.Racers, defaultRacers)
+	}
+
+	// down upstreams never race with the healthy ones - they are asked only when all the healthy ones failed
+	healthy, down := p.order()
+	var errs []error
+	for _, members := range [][]*poolMember{healthy, down} {
+		for start := 0; start < len(members); start += racers {
+			if err := ctx.Err(); err != nil {
+				return DNSMessage{}, errors.Join(append(errs, err)...)
+			}
+
+			response, err := p.race(ctx, query, members[start:min(start+racers, len(members))])
+			if err == nil {
+				return response, nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	return DNSMessage{}, errors.Join(errs...)
+}
+
+// sends the query to all the members at once and returns the first answer - queries to the others are cancelled
+// SERVFAIL or REFUSED loses to any other answer and is returned only when no other answer comes
+func (p *UpstreamPool) race(ctx context.Context, query DNSMessage, members []*poolMember) (DNSMessage, error) {
+	if len(members) == 1 {
+		return p.exchange(ctx, members[0], query)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		response DNSMessage
+		err      error
+	}
+	// buffered so the losers don't wait for anyone to read their result
+	results := make(chan result, len(members))
+	for _, member := range members {
+		go func() {
+			response, err := p.exchange(ctx, member, query)
+			results <- result{response, err}
+		}()
+	}
+
+	var failure *DNSMessage
+	var errs []error
+	for range members {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+
+		switch result.response.Header.FLAGS.GetRcode() {
+		case RcodeServerFailure, RcodeRefused:
+			failure = &result.response
+		default:
+			return result.response, nil
+		}
+	}
+
+	if failure != nil {
+		return *failure, nil
+	}
+	return DNSMessage{}, errors.Join(errs...)
+}
+
+// sends the query to single member keeping track of its health
+func (p *UpstreamPool) exchange(ctx context.Context, member *poolMember, query DNSMessage) (DNSMessage, error) {
+	started := p.now()
+	response, err := member.upstream.Exchange(ctx, query)
+	if err != nil {
+		// query cancelled by the caller (or because other upstream won the race) says nothing about the upstream
+		if ctx.Err() == nil {
+			p.failed(member)
+		}
+		return DNSMessage{}, fmt.Errorf("%s: %w", member.upstream, err)
+	}
+
+	p.succeeded(member, p.now().Sub(started))
+	return response, nil
+}
+
+// healthy upstreams in the order given by strategy and the down ones - soonest back up first
+func (p *UpstreamPool) order() (healthy []*poolMember, down []*poolMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for _, member := range p.members {
+		if now.Before(member.downUntil) {
+			down = append(down, member)
+		} else {
+			healthy = append(healthy, member)
+		}
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(healthy) > 0 {
+			start := int(p.next % uint64(len(healthy)))
+			p.next++
+			healthy = slices.Concat(healthy[start:], healthy[:start])
+		}
+	case StrategyRandom:
+		rand.Shuffle(len(healthy), func(i, j int) { healthy[i], healthy[j] = healthy[j], healthy[i] })
+	case StrategyFastest, StrategyRace:
+		// upstreams without measurement go first so they get one
+		slices.SortStableFunc(healthy, func(a, b *poolMember) int {
+			return cmp.Compare(a.srtt, b.srtt)
+		})
+	}
+
+	slices.SortStableFunc(down, func(a, b *poolMember) int {
+		return a.downUntil.Compare(b.downUntil)
+	})
+	return healthy, down
+}
+
+// smoothing the same way TCP does - https://www.rfc-editor.org/rfc/rfc6298#section-2
+func (p *UpstreamPool) succeeded(member *poolMember, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if member.srtt == 0 {
+		member.srtt = rtt
+	} else {
+		member.srtt = (7*member.srtt + rtt) / 8
+	}
+	member.failures = 0
+	member.downUntil = time.Time{}
+	member.downTime = 0
+}
+
+func (p *UpstreamPool) failed(member *poolMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	member.failures++
+	if member.failures < maxUpstreamFailures {
+		return
+	}
+
+	// still failing after it was given another chance - wait longer this time
+	if member.downTime == 0 {
+		member.downTime = upstreamDownTime
+	} else {
+		member.downTime = min(2*member.downTime, maxUpstreamDownTime)
+	}
+	member.downUntil = p.now().Add(member.downTime)
+	fmt.Printf("Upstream %s is down for %v after %d failures\n", member.upstream, member.downTime, member.failures)
+}
+
+// Close closes all the upstreams
+func (p *UpstreamPool) Close() error {
+	var errs []error
+	for _, member := range p.members {
+		errs = append(errs, member.upstream.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// upstream counting queries it got - answers only when alive
+func newTestPoolUpstream(t *testing.T, alive bool) (*Upstream, *atomic.Int32) {
+	var queries atomic.Int32
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		queries.Add(1)
+		if !alive {
+			return nil
+		}
+		return newTestResponse(query)
+	})
+	upstream.Retry = RetryPolicy{Attempts: 1, AttemptTimeout: 20 * time.Millisecond, MaxAttemptTimeout: 20 * time.Millisecond}
+	return upstream, &queries
+}
+
+// pool with clock that moves only when the test says so
+func newTestPool(strategy UpstreamStrategy, upstreams ...*Upstream) (*UpstreamPool, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool := NewUpstreamPool(strategy, upstreams...)
+	pool.now = func() time.Time { return now }
+	return pool, &now
+}
+
+func TestUpstreamStrategyText(t *testing.T) {
+	for _, strategy := range []UpstreamStrategy{StrategyFailover, StrategyRoundRobin, StrategyRandom, StrategyFastest, StrategyRace} {
+		var parsed UpstreamStrategy
+		err := parsed.UnmarshalText([]byte(strategy.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, strategy, parsed)
+	}
+
+	var parsed UpstreamStrategy
+	assert.Error(t, parsed.UnmarshalText([]byte("fastest-first")))
+	assert.Equal(t, "UpstreamStrategy(7)", UpstreamStrategy(7).String())
+}
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	dead, deadQueries := newTestPoolUpstream(t, false)
+	alive, aliveQueries := newTestPoolUpstream(t, true)
+	pool, now := newTestPool(StrategyFailover, dead, alive)
+
+	for range maxUpstreamFailures + 2 {
+		_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+		assert.NoError(t, err)
+	}
+	// dead one is skipped once it failed enough times in a row
+	assert.Equal(t, int32(maxUpstreamFailures), deadQueries.Load())
+	assert.Equal(t, int32(maxUpstreamFailures+2), aliveQueries.Load())
+
+	// and gets another chance later
+	*now = now.Add(upstreamDownTime)
+	_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(maxUpstreamFailures+1), deadQueries.Load())
+
+	// it failed again so it's down for longer
+	*now = now.Add(upstreamDownTime)
+	_, err = pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(maxUpstreamFailures+1), deadQueries.Load())
+	assert.Equal(t, 2*upstreamDownTime, pool.members[0].downTime)
+}
+
+func TestUpstreamPoolRecovers(t *testing.T) {
+	upstream, _ := newTestPoolUpstream(t, true)
+	pool, now := newTestPool(StrategyFailover, upstream)
+	member := pool.members[0]
+
+	for range maxUpstreamFailures {
+		pool.failed(member)
+	}
+	assert.Equal(t, now.Add(upstreamDownTime), member.downUntil)
+
+	// all upstreams are down - they are still asked
+	_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, member.failures)
+	assert.True(t, member.downUntil.IsZero())
+}
+
+func TestUpstreamPoolAllFail(t *testing.T) {
+	first, firstQueries := newTestPoolUpstream(t, false)
+	second, secondQueries := newTestPoolUpstream(t, false)
+	pool, _ := newTestPool(StrategyFailover, first, second)
+
+	_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.ErrorIs(t, err, ErrUpstreamTimeout)
+	assert.Contains(t, err.Error(), first.String())
+	assert.Contains(t, err.Error(), second.String())
+	assert.Equal(t, int32(1), firstQueries.Load())
+	assert.Equal(t, int32(1), secondQueries.Load())
+
+	_, err = NewUpstreamPool(StrategyFailover).Exchange(context.Background(), newTestQuery(t, nil))
+	assert.Error(t, err)
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	var upstreams []*Upstream
+	var queries []*atomic.Int32
+	for range 3 {
+		upstream, counter := newTestPoolUpstream(t, true)
+		upstreams = append(upstreams, upstream)
+		queries = append(queries, counter)
+	}
+	pool, _ := newTestPool(StrategyRoundRobin, upstreams...)
+
+	for range 6 {
+		_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+		assert.NoError(t, err)
+	}
+	for _, counter := range queries {
+		assert.Equal(t, int32(2), counter.Load())
+	}
+}
+
+func TestUpstreamPoolRandom(t *testing.T) {
+	first, _ := newTestPoolUpstream(t, true)
+	second, _ := newTestPoolUpstream(t, true)
+	pool, _ := newTestPool(StrategyRandom, first, second)
+
+	firsts := map[*poolMember]bool{}
+	for range 100 {
+		order, down := pool.order()
+		assert.Empty(t, down)
+		assert.ElementsMatch(t, pool.members, order)
+		firsts[order[0]] = true
+	}
+	assert.Len(t, firsts, 2)
+}
+
+func TestUpstreamPoolFastest(t *testing.T) {
+	first, _ := newTestPoolUpstream(t, true)
+	second, _ := newTestPoolUpstream(t, true)
+	down, _ := newTestPoolUpstream(t, true)
+	unmeasured, _ := newTestPoolUpstream(t, true)
+	pool, _ := newTestPool(StrategyFastest, first, second, down, unmeasured)
+
+	pool.succeeded(pool.members[0], 80*time.Millisecond)
+	pool.succeeded(pool.members[1], 80*time.Millisecond)
+	pool.succeeded(pool.members[2], time.Millisecond)
+	for range maxUpstreamFailures {
+		pool.failed(pool.members[2])
+	}
+	// smoothed so a single fast answer doesn't change much
+	pool.succeeded(pool.members[0], 0)
+	pool.succeeded(pool.members[1], 40*time.Millisecond)
+	assert.Equal(t, 70*time.Millisecond, pool.members[0].srtt)
+	assert.Equal(t, 75*time.Millisecond, pool.members[1].srtt)
+
+	healthy, unavailable := pool.order()
+	assert.Equal(t, []*poolMember{pool.members[3], pool.members[0], pool.members[1]}, healthy)
+	assert.Equal(t, []*poolMember{pool.members[2]}, unavailable)
+}
+
+// upstream answering with the rcode after the delay
+func newTestRacingUpstream(t *testing.T, delay time.Duration, rcode uint16) *Upstream {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		time.Sleep(delay)
+		response := newTestResponse(query)
+		_ = response.Header.FLAGS.SetRcode(rcode)
+		return response
+	})
+	upstream.Retry = RetryPolicy{Attempts: 1, AttemptTimeout: time.Second, MaxAttemptTimeout: time.Second}
+	return upstream
+}
+
+func TestUpstreamPoolRace(t *testing.T) {
+	slow := newTestRacingUpstream(t, 500*time.Millisecond, RcodeSuccess)
+	failing := newTestRacingUpstream(t, 0, RcodeServerFailure)
+	fast := newTestRacingUpstream(t, 50*time.Millisecond, RcodeNameError)
+	pool, _ := newTestPool(StrategyRace, slow, failing, fast)
+	pool.Racers = 3
+
+	started := time.Now()
+	response, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	// SERVFAIL came first but lost to the real answer
+	assert.Equal(t, RcodeNameError, response.Header.FLAGS.GetRcode())
+	assert.Less(t, time.Since(started), 400*time.Millisecond)
+
+	// query to the slow one is cancelled and doesn't count as its failure
+	assert.Eventually(t, func() bool {
+		slow.mu.Lock()
+		defer slow.mu.Unlock()
+		return len(slow.pending) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, pool.members[0].failures)
+}
+
+func TestUpstreamPoolRaceOnlyFailures(t *testing.T) {
+	failing := newTestRacingUpstream(t, 0, RcodeServerFailure)
+	dead, _ := newTestPoolUpstream(t, false)
+	pool, _ := newTestPool(StrategyRace, failing, dead)
+
+	response, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, RcodeServerFailure, response.Header.FLAGS.GetRcode())
+	assert.Equal(t, 1, pool.members[1].failures)
+}
+
+func TestUpstreamPoolRaceNextRacers(t *testing.T) {
+	first, firstQueries := newTestPoolUpstream(t, false)
+	second, secondQueries := newTestPoolUpstream(t, false)
+	third, thirdQueries := newTestPoolUpstream(t, true)
+	pool, _ := newTestPool(StrategyRace, first, second, third)
+
+	for range maxUpstreamFailures {
+		_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(maxUpstreamFailures), firstQueries.Load())
+	assert.Equal(t, int32(maxUpstreamFailures), secondQueries.Load())
+	assert.Equal(t, int32(maxUpstreamFailures), thirdQueries.Load())
+
+	// the first pair is down so the one that answers races alone
+	_, err := pool.Exchange(context.Background(), newTestQuery(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(maxUpstreamFailures), firstQueries.Load())
+	assert.Equal(t, int32(maxUpstreamFailures+1), thirdQueries.Load())
+}
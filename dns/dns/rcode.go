@@ -0,0 +1,56 @@
+package dns
+
+import "fmt"
+
+// response codes - https://www.rfc-editor.org/rfc/rfc1035#section-4.1.1
+// 4 bits in the header so up to 15, anything above needs EDNS extended rcode
+const (
+	RcodeSuccess        uint16 = 0 // NOERROR
+	RcodeFormatError    uint16 = 1 // FORMERR - we couldn't understand the query
+	RcodeServerFailure  uint16 = 2 // SERVFAIL - we understood the query but failed to get the answer
+	RcodeNameError      uint16 = 3 // NXDOMAIN - name doesn't exist
+	RcodeNotImplemented uint16 = 4 // NOTIMP - we don't support this kind of query
+	RcodeRefused        uint16 = 5 // REFUSED - we won't answer it
+)
+
+// only standard query is supported - inverse query (1) is obsolete, status (2), notify (4) and update (5) are not implemented
+const OpcodeQuery uint16 = 0
+
+// query types that are about the zone as a whole and need TCP
+const (
+	TypeIXFR uint16 = 251
+	TypeAXFR uint16 = 252
+)
+
+// ClassANY is allowed in the question section together with IN
+const ClassANY uint16 = 255
+
+// TypeANY asks for all the records of the name
+const TypeANY uint16 = 255
+
+// Decides if the query should be answered at all and if not with what rcode
+// it is checked before we touch the resolver so refused queries don't cost anything
+// returns RcodeSuccess when query can be answered
+func queryPolicy(receivedMessage DNSMessage) (uint16, string) {
+	if receivedMessage.Header.FLAGS.GetOpCode() != OpcodeQuery {
+		return RcodeNotImplemented, fmt.Sprintf("opcode %d is not supported", receivedMessage.Header.FLAGS.GetOpCode())
+	}
+
+	if len(receivedMessage.Questions) == 0 {
+		return RcodeFormatError, "query without questions"
+	}
+
+	for _, question := range receivedMessage.Questions {
+		// CHAOS, HESIOD etc - we only serve internet class
+		if question.Class != ClassIN && question.Class != ClassANY {
+			return RcodeRefused, fmt.Sprintf("class %d is not served", question.Class)
+		}
+
+		// zone transfers are not something we allow anyone to do
+		if question.Type == TypeAXFR || question.Type == TypeIXFR {
+			return RcodeRefused, fmt.Sprintf("zone transfer type %d is not allowed", question.Type)
+		}
+	}
+
+	return RcodeSuccess, ""
+}
@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	newQuery := func(opcode uint16, questions ...DNSQuestion) DNSMessage {
+		query := DNSMessage{Questions: questions}
+		err := query.Header.FLAGS.SetOpCode(opcode)
+		assert.NoError(t, err)
+		return query
+	}
+	name := EncodeName("mfranc.com")
+
+	tests := []struct {
+		query    DNSMessage
+		expected uint16
+	}{
+		{newQuery(0, DNSQuestion{Name: name, Type: TypeA, Class: ClassIN}), RcodeSuccess},
+		{newQuery(0, DNSQuestion{Name: name, Type: TypeMX, Class: ClassANY}), RcodeSuccess},
+		{newQuery(0), RcodeFormatError},
+		{newQuery(1, DNSQuestion{Name: name, Type: TypeA, Class: ClassIN}), RcodeNotImplemented},
+		{newQuery(5, DNSQuestion{Name: name, Type: TypeSOA, Class: ClassIN}), RcodeNotImplemented},
+		{newQuery(0, DNSQuestion{Name: name, Type: TypeTXT, Class: 3}), RcodeRefused},
+		{newQuery(0, DNSQuestion{Name: name, Type: TypeA, Class: ClassIN}, DNSQuestion{Name: name, Type: TypeAXFR, Class: ClassIN}), RcodeRefused},
+		{newQuery(0, DNSQuestion{Name: name, Type: TypeIXFR, Class: ClassIN}), RcodeRefused},
+	}
+
+	for _, test := range tests {
+		rcode, reason := queryPolicy(test.query)
+		assert.Equal(t, test.expected, rcode, reason)
+		if rcode != RcodeSuccess {
+			assert.NotEmpty(t, reason)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// record types - https://www.rfc-editor.org/rfc/rfc1035#section-3.2.2 and later rfcs for AAAA, SRV and CAA
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeCAA   uint16 = 257
+)
+
+// ClassIN - Internet, the only class anyone really uses
+const ClassIN uint16 = 1
+
+// RData is a typed representation of the answer Data field
+// Encode returns the uncompressed wire format that can be put straight into DNSAnswer.Data
+type RData interface {
+	Type() uint16
+	Encode() ([]byte, error)
+}
+
+type RDataA struct {
+	IP net.IP
+}
+
+type RDataAAAA struct {
+	IP net.IP
+}
+
+type RDataCNAME struct {
+	Target string
+}
+
+type RDataNS struct {
+	Host string
+}
+
+type RDataPTR struct {
+	Target string
+}
+
+type RDataMX struct {
+	Preference uint16
+	Exchange   string
+}
+
+// TXT is one or more character strings each up to 255 bytes
+type RDataTXT struct {
+	Texts []string
+}
+
+type RDataSOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+type RDataSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// https://www.rfc-editor.org/rfc/rfc8659#section-4.1
+type RDataCAA struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (r *RDataA) Type() uint16     { return TypeA }
+func (r *RDataAAAA) Type() uint16  { return TypeAAAA }
+func (r *RDataCNAME) Type() uint16 { return TypeCNAME }
+func (r *RDataNS) Type() uint16    { return TypeNS }
+func (r *RDataPTR) Type() uint16   { return TypePTR }
+func (r *RDataMX) Type() uint16    { return TypeMX }
+func (r *RDataTXT) Type() uint16   { return TypeTXT }
+func (r *RDataSOA) Type() uint16   { return TypeSOA }
+func (r *RDataSRV) Type() uint16   { return TypeSRV }
+func (r *RDataCAA) Type() uint16   { return TypeCAA }
+
+func (r *RDataA) Encode() ([]byte, error) {
+	ip := r.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("A record requires ipv4 address got: %v", r.IP)
+	}
+	return []byte(ip), nil
+}
+
+func (r *RDataAAAA) Encode() ([]byte, error) {
+	// To4 check is here as To16 will happily convert ipv4 address as well
+	if r.IP.To4() != nil || r.IP.To16() == nil {
+		return nil, fmt.Errorf("AAAA record requires ipv6 address got: %v", r.IP)
+	}
+	return []byte(r.IP.To16()), nil
+}
+
+func (r *RDataCNAME) Encode() ([]byte, error) {
+	return encodeCheckedName(r.Target)
+}
+
+func (r *RDataNS) Encode() ([]byte, error) {
+	return encodeCheckedName(r.Host)
+}
+
+func (r *RDataPTR) Encode() ([]byte, error) {
+	return encodeCheckedName(r.Target)
+}
+
+func (r *RDataMX) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, r.Preference); err != nil {
+		return nil, err
+	}
+	exchange, err := encodeCheckedName(r.Exchange)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(exchange)
+	return buf.Bytes(), nil
+}
+
+func (r *RDataTXT) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, text := range r.Texts {
+		if len(text) > 255 {
+			return nil, fmt.Errorf("TXT character string is longer than 255 bytes: %d", len(text))
+		}
+		buf.WriteByte(uint8(len(text)))
+		buf.WriteString(text)
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RDataSOA) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, name := range []string{r.MName, r.RName} {
+		encoded, err := encodeCheckedName(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encoded)
+	}
+	for _, v := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RDataSRV) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, v := range []uint16{r.Priority, r.Weight, r.Port} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	target, err := encodeCheckedName(r.Target)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(target)
+	return buf.Bytes(), nil
+}
+
+func (r *RDataCAA) Encode() ([]byte, error) {
+	if len(r.Tag) == 0 || len(r.Tag) > 255 {
+		return nil, fmt.Errorf("CAA tag has to be between 1 and 255 bytes got: %d", len(r.Tag))
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(r.Flags)
+	buf.WriteByte(uint8(len(r.Tag)))
+	buf.WriteString(r.Tag)
+	// value is not length prefixed it takes the rest of the RDATA
+	buf.WriteString(r.Value)
+	return buf.Bytes(), nil
+}
+
+// NewAnswer builds answer with Type, Length and Data filled from the typed rdata
+// names (the owner and the ones in rdata) can be fully qualified with the trailing dot
+func NewAnswer(name string, class uint16, ttl uint32, rdata RData) (DNSAnswer, error) {
+	owner, err := encodeCheckedName(name)
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	data, err := rdata.Encode()
+	if err != nil {
+		return DNSAnswer{}, fmt.Errorf("failed to encode rdata for %s: %w", name, err)
+	}
+
+	return DNSAnswer{
+		Name:   owner,
+		Type:   rdata.Type(),
+		Class:  class,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}, nil
+}
+
+// EncodeName for names we build records with - unlike names from the wire nothing checked them yet
+// one trailing dot is dropped (example.com. is example.com) and labels and length have to fit the wire format
+// https://www.rfc-editor.org/rfc/rfc1035#section-2.3.4
+func encodeCheckedName(name string) ([]byte, error) {
+	if isAbsoluteName(name) {
+		name = strings.TrimSuffix(name, ".")
+	}
+	if name == "" {
+		return EncodeName(""), nil
+	}
+
+	for _, label := range splitName(name) {
+		if label == "" {
+			return nil, fmt.Errorf("invalid name %q: empty label", name)
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q: %w", name, ErrLabelTooLong)
+		}
+	}
+	encoded := EncodeName(name)
+	if len(encoded) > 255 {
+		return nil, fmt.Errorf("invalid name %q: %w", name, ErrNameTooLong)
+	}
+	return encoded, nil
+}
+
+// RData parses answer Data into typed record
+// Data is expected to be uncompressed which is what DNSAnswer.Decode leaves there
+func (answer *DNSAnswer) RData() (RData, error) {
+	return decodeRData(answer.Type, answer.Data, 0, uint16(len(answer.Data)))
+}
+
+// Reads rdata of given type that starts at offset in messageBytes
+// full message is needed here as names inside rdata (CNAME, NS, MX, SOA ...) can be compressed
+// and point anywhere before them in the message
+func decodeRData(rrType uint16, messageBytes []byte, offset int, length uint16) (RData, error) {
+	end := offset + int(length)
+	if end > len(messageBytes) {
+		return nil, fmt.Errorf("rdata length %d exceeds message size %d at offset %d: %w", length, len(messageBytes), offset, ErrTruncated)
+	}
+	data := messageBytes[offset:end]
+
+	switch rrType {
+	case TypeA:
+		if len(data) != net.IPv4len {
+			return nil, fmt.Errorf("A record rdata has to be 4 bytes got: %d", len(data))
+		}
+		return &RDataA{IP: net.IP(append([]byte{}, data...))}, nil
+	case TypeAAAA:
+		if len(data) != net.IPv6len {
+			return nil, fmt.Errorf("AAAA record rdata has to be 16 bytes got: %d", len(data))
+		}
+		return &RDataAAAA{IP: net.IP(append([]byte{}, data...))}, nil
+	case TypeCNAME:
+		target, _, err := rdataName(messageBytes, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return &RDataCNAME{Target: target}, nil
+	case TypeNS:
+		host, _, err := rdataName(messageBytes, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return &RDataNS{Host: host}, nil
+	case TypePTR:
+		target, _, err := rdataName(messageBytes, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return &RDataPTR{Target: target}, nil
+	case TypeMX:
+		preference, nameOffset, err := ReadUint16(data, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MX preference: %w", err)
+		}
+		exchange, _, err := rdataName(messageBytes, offset+nameOffset, end)
+		if err != nil {
+			return nil, err
+		}
+		return &RDataMX{Preference: preference, Exchange: exchange}, nil
+	case TypeTXT:
+		txt := &RDataTXT{}
+		for i := 0; i < len(data); {
+			textLength := int(data[i])
+			i++
+			if i+textLength > len(data) {
+				return nil, fmt.Errorf("TXT character string length %d exceeds rdata: %w", textLength, ErrTruncated)
+			}
+			txt.Texts = append(txt.Texts, string(data[i:i+textLength]))
+			i += textLength
+		}
+		return txt, nil
+	case TypeSOA:
+		mname, nameOffset, err := rdataName(messageBytes, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		rname, nameOffset, err := rdataName(messageBytes, nameOffset, end)
+		if err != nil {
+			return nil, err
+		}
+		// 5 x 32 bit values follow the names
+		if end-nameOffset != 20 {
+			return nil, fmt.Errorf("SOA record has %d bytes after names expected 20", end-nameOffset)
+		}
+		soa := &RDataSOA{MName: mname, RName: rname}
+		for _, field := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+			*field, nameOffset, err = ReadUint32(messageBytes, nameOffset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SOA values: %w", err)
+			}
+		}
+		return soa, nil
+	case TypeSRV:
+		srv := &RDataSRV{}
+		// values are read from data so they can't run past rdata length
+		dataOffset := 0
+		var err error
+		for _, field := range []*uint16{&srv.Priority, &srv.Weight, &srv.Port} {
+			*field, dataOffset, err = ReadUint16(data, dataOffset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SRV values: %w", err)
+			}
+		}
+		target, _, err := rdataName(messageBytes, offset+dataOffset, end)
+		if err != nil {
+			return nil, err
+		}
+		srv.Target = target
+		return srv, nil
+	case TypeCAA:
+		if len(data) < 2 {
+			return nil, fmt.Errorf("CAA record rdata too short %d: %w", len(data), ErrTruncated)
+		}
+		tagLength := int(data[1])
+		if 2+tagLength > len(data) {
+			return nil, fmt.Errorf("CAA tag length %d exceeds rdata: %w", tagLength, ErrTruncated)
+		}
+		return &RDataCAA{
+			Flags: data[0],
+			Tag:   string(data[2 : 2+tagLength]),
+			Value: string(data[2+tagLength:]),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported record type: %d", rrType)
+}
+
+// names inside rdata go through the same ExtractName as owner names so pointers are followed
+// returns name as dotted string and offset right after the name - only for the typed view
+// wire format is copied with decompressRData so labels are not changed
+func rdataName(messageBytes []byte, offset int, end int) (string, int, error) {
+	name, nameLength, err := ExtractName(messageBytes, offset)
+	if err != nil {
+		return "", -1, fmt.Errorf("failed to extract name from rdata: %w", err)
+	}
+
+	offset += nameLength
+	if offset > end {
+		return "", -1, fmt.Errorf("name in rdata runs past rdata length: %w", ErrTruncated)
+	}
+
+	return DecodeName(name), offset, nil
+}
+
+// copy of rdata with compressed names replaced by their labels - the labels are copied byte by byte
+// and never go through dotted strings so a label with a dot inside (john.doe in SOA RNAME) stays one label
+func decompressRData(rrType uint16, messageBytes []byte, offset int, length uint16) ([]byte, error) {
+	end := offset + int(length)
+	if end > len(messageBytes) {
+		return nil, fmt.Errorf("rdata length %d exceeds message size %d at offset %d: %w", length, len(messageBytes), offset, ErrTruncated)
+	}
+
+	before, names, after := rdataNameLayout(rrType)
+	if offset+before > end {
+		return nil, fmt.Errorf("rdata of type %d too short %d: %w", rrType, length, ErrTruncated)
+	}
+	data := append([]byte{}, messageBytes[offset:offset+before]...)
+	offset += before
+
+	for range names {
+		name, nameLength, err := ExtractName(messageBytes, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract name from rdata: %w", err)
+		}
+		offset += nameLength
+		if offset > end {
+			return nil, fmt.Errorf("name in rdata runs past rdata length: %w", ErrTruncated)
+		}
+		data = append(data, name...)
+	}
+
+	if end-offset != after {
+		return nil, fmt.Errorf("rdata of type %d has %d bytes after names expected %d", rrType, end-offset, after)
+	}
+	return append(data, messageBytes[offset:end]...), nil
+}
+
+// where the names are in rdata - fixed size fields before them, how many names and fixed size fields after them
+func rdataNameLayout(rrType uint16) (before int, names int, after int) {
+	switch rrType {
+	case TypeMX:
+		// preference
+		return 2, 1, 0
+	case TypeSOA:
+		// serial, refresh, retry, expire and minimum
+		return 0, 2, 20
+	case TypeSRV:
+		// priority, weight and port
+		return 6, 1, 0
+	}
+	// CNAME, NS and PTR are only the name
+	return 0, 1, 0
+}
+
+// types that carry domain names in rdata - for these the raw bytes can contain pointers
+// into the message they came from, which become garbage once the record is moved into another message
+func hasNameInRData(rrType uint16) bool {
+	switch rrType {
+	case TypeCNAME, TypeNS, TypePTR, TypeMX, TypeSOA, TypeSRV:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRDataEncodeDecode(t *testing.T) {
+	tests := []RData{
+		&RDataA{IP: net.ParseIP("8.8.8.8").To4()},
+		&RDataAAAA{IP: net.ParseIP("2001:db8::1")},
+		&RDataCNAME{Target: "www.mfranc.com"},
+		&RDataNS{Host: "ns1.mfranc.com"},
+		&RDataPTR{Target: "host.mfranc.com"},
+		&RDataMX{Preference: 10, Exchange: "mail.mfranc.com"},
+		&RDataTXT{Texts: []string{"v=spf1 -all", "second"}},
+		&RDataSOA{MName: "ns1.mfranc.com", RName: "admin.mfranc.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+		&RDataSRV{Priority: 10, Weight: 5, Port: 5060, Target: "sip.mfranc.com"},
+		&RDataCAA{Flags: 0, Tag: "issue", Value: "letsencrypt.org"},
+	}
+
+	for _, rdata := range tests {
+		answer, err := NewAnswer("mfranc.com", ClassIN, 60, rdata)
+		assert.NoError(t, err)
+		assert.Equal(t, rdata.Type(), answer.Type)
+		assert.Equal(t, uint16(len(answer.Data)), answer.Length)
+
+		// go through the wire format to make sure Decode leaves data parsable
+		answerEncoded, err := answer.Encode()
+		assert.NoError(t, err)
+
+		decodedAnswer := DNSAnswer{}
+		_, err = decodedAnswer.Decode(answerEncoded, 0)
+		assert.NoError(t, err)
+
+		decoded, err := decodedAnswer.RData()
+		assert.NoError(t, err)
+		assert.Equal(t, rdata, decoded, "type %d", rdata.Type())
+	}
+}
+
+// fully qualified names are the same as the ones without the trailing dot
+func TestRDataTrailingDot(t *testing.T) {
+	tests := []struct {
+		qualified RData
+		plain     RData
+	}{
+		{&RDataCNAME{Target: "target.example.com."}, &RDataCNAME{Target: "target.example.com"}},
+		{&RDataNS{Host: "ns1.example.com."}, &RDataNS{Host: "ns1.example.com"}},
+		{&RDataPTR{Target: "host.example.com."}, &RDataPTR{Target: "host.example.com"}},
+		{&RDataMX{Preference: 10, Exchange: "mail.example.com."}, &RDataMX{Preference: 10, Exchange: "mail.example.com"}},
+		{&RDataSOA{MName: "ns1.example.com.", RName: "admin.example.com."}, &RDataSOA{MName: "ns1.example.com", RName: "admin.example.com"}},
+		{&RDataSRV{Port: 5060, Target: "sip.example.com."}, &RDataSRV{Port: 5060, Target: "sip.example.com"}},
+		{&RDataNS{Host: "."}, &RDataNS{Host: ""}},
+	}
+
+	for _, test := range tests {
+		qualified, err := test.qualified.Encode()
+		assert.NoError(t, err)
+		plain, err := test.plain.Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, plain, qualified)
+	}
+
+	answer, err := NewAnswer("www.example.com.", ClassIN, 60, &RDataCNAME{Target: "target.example.com."})
+	assert.NoError(t, err)
+	assert.Equal(t, EncodeName("www.example.com"), answer.Name)
+	assert.Equal(t, EncodeName("target.example.com"), answer.Data)
+}
+
+// names that can't be put on the wire are refused instead of producing broken rdata
+func TestRDataInvalidNames(t *testing.T) {
+	longLabel := strings.Repeat("a", 64)
+	longName := strings.Repeat("a.", 127) + "aa"
+
+	for _, rdata := range []RData{
+		&RDataCNAME{Target: longLabel + ".example.com"},
+		&RDataNS{Host: "a..example.com"},
+		&RDataPTR{Target: "example.com.."},
+		&RDataMX{Exchange: longLabel},
+		&RDataSOA{MName: "ns1.example.com", RName: longName},
+		&RDataSRV{Target: longLabel},
+	} {
+		_, err := rdata.Encode()
+		assert.Error(t, err, "%#v", rdata)
+	}
+
+	_, err := (&RDataCNAME{Target: longLabel}).Encode()
+	assert.ErrorIs(t, err, ErrLabelTooLong)
+	_, err = (&RDataCNAME{Target: longName}).Encode()
+	assert.ErrorIs(t, err, ErrNameTooLong)
+
+	_, err = NewAnswer(longLabel+".example.com", ClassIN, 60, &RDataA{IP: net.IPv4(192, 0, 2, 1)})
+	assert.ErrorIs(t, err, ErrLabelTooLong)
+	_, err = NewAnswer("www.example.com", ClassIN, 60, &RDataCNAME{Target: longLabel})
+	assert.ErrorIs(t, err, ErrLabelTooLong)
+}
+
+func TestRDataInvalid(t *testing.T) {
+	_, err := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.ParseIP("2001:db8::1")})
+	assert.Error(t, err)
+
+	_, err = NewAnswer("mfranc.com", ClassIN, 60, &RDataAAAA{IP: net.ParseIP("8.8.8.8")})
+	assert.Error(t, err)
+
+	_, err = decodeRData(TypeA, []byte{1, 2, 3}, 0, 3)
+	assert.Error(t, err)
+
+	_, err = decodeRData(TypeTXT, []byte{5, 'a'}, 0, 2)
+	assert.Error(t, err)
+
+	_, err = decodeRData(999, []byte{1}, 0, 1)
+	assert.Error(t, err)
+}
+
+// CNAME target pointing back at the owner name via compression pointer
+func TestRDataCompressedName(t *testing.T) {
+	// header is skipped - owner mfranc.com at offset 0
+	data := []byte{0x06, 'm', 'f', 'r', 'a', 'n', 'c', 0x03, 'c', 'o', 'm', 0x00}
+	// type CNAME class IN ttl 60
+	data = append(data, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c)
+	// rdlength 6 - www + pointer to offset 0
+	data = append(data, 0x00, 0x06, 0x03, 'w', 'w', 'w', 0xc0, 0x00)
+
+	answer := DNSAnswer{}
+	offset, err := answer.Decode(data, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), offset)
+
+	// data is stored decompressed so it does not depend on the original message anymore
+	assert.Equal(t, EncodeName("www.mfranc.com"), answer.Data)
+	assert.Equal(t, uint16(len(answer.Data)), answer.Length)
+
+	rdata, err := answer.RData()
+	assert.NoError(t, err)
+	assert.Equal(t, &RDataCNAME{Target: "www.mfranc.com"}, rdata)
+}
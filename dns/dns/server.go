@@ -0,0 +1,462 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxInFlight    = 100
+	defaultTCPConnections = 100
+	defaultTCPIdleTimeout = 10 * time.Second
+)
+
+// ErrServerClosed is returned by Serve and Listen after Shutdown was called
+var ErrServerClosed = errors.New("server closed")
+
+// Handler answers a single query
+// queries that can't be decoded, are not queries or ask for something this server doesn't support
+// never reach the handler - they are answered by the server on its own, see handlePacket
+// handler that returns without writing a response gets SERVFAIL sent for it
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, req *DNSMessage)
+}
+
+// HandlerFunc lets an ordinary function be used as Handler
+type HandlerFunc func(ctx context.Context, w ResponseWriter, req *DNSMessage)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+	f(ctx, w, req)
+}
+
+// ResponseWriter sends the response to the client that sent the query
+type ResponseWriter interface {
+	// WriteMsg can be called only once - OPT is set to match the query
+	// and the response is trimmed to what the client can receive, see encodeResponse
+	WriteMsg(response *DNSMessage) error
+	RemoteAddr() net.Addr
+}
+
+// keeps the encoded response so the transport can send it once the handler returns
+type responseWriter struct {
+	request  DNSMessage
+	remote   net.Addr
+	maxSize  int
+	response []byte
+}
+
+func (w *responseWriter) WriteMsg(response *DNSMessage) error {
+	if w.response != nil {
+		return errors.New("response was already written")
+	}
+
+	encoded, err := encodeResponse(w.request, *response, w.maxSize)
+	if err != nil {
+		return err
+	}
+	w.response = encoded
+	return nil
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// Server answers DNS queries over UDP and TCP on all of its addresses using the same Handler
+// it can be started in process - Listen opens the sockets (so with port 0 LocalAddrs tells where it listens)
+// and Serve answers queries until Shutdown is called
+type Server struct {
+	// addresses in the same format as --listen flag, see listenAddress - defaults to 127.0.0.1:2053
+	Addrs   []string
+	Handler Handler
+	// zero values mean defaults - 100 queries at the same time on each UDP socket,
+	// 100 connections on each TCP socket and 10s idle timeout
+	MaxInFlight    int
+	TCPConnections int
+	TCPIdleTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners *listeners
+	tcpConns  map[net.Conn]struct{}
+	serving   bool
+	closed    bool
+	// handlers get ctx that is cancelled when Shutdown runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// ListenAndServe opens sockets for all the addresses and answers queries until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen opens sockets for all the addresses - all of them or none
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.listeners != nil {
+		return errors.New("server is already listening")
+	}
+
+	addrs := s.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{defaultListenAddress}
+	}
+
+	var listenAddresses []listenAddress
+	for _, value := range addrs {
+		listen, err := parseListenAddress(value)
+		if err != nil {
+			return err
+		}
+		listenAddresses = append(listenAddresses, listen)
+	}
+
+	opened, err := openListeners(listenAddresses)
+	if err != nil {
+		return err
+	}
+	s.listeners = opened
+	return nil
+}
+
+// LocalAddrs returns addresses of the sockets opened by Listen, UDP ones first
+func (s *Server) LocalAddrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		return nil
+	}
+
+	var addrs []net.Addr
+	for _, udpConn := range s.listeners.udp {
+		addrs = append(addrs, udpConn.LocalAddr())
+	}
+	for _, tcpListener := range s.listeners.tcp {
+		addrs = append(addrs, tcpListener.Addr())
+	}
+	return addrs
+}
+
+// Serve answers queries on the sockets opened by Listen and blocks until all of them are done
+// returns ErrServerClosed after Shutdown
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.mu.Unlock()
+		return errors.New("Listen has to be called before Serve")
+	}
+	if s.serving {
+		s.mu.Unlock()
+		return errors.New("server is already serving")
+	}
+	if s.Handler == nil {
+		s.mu.Unlock()
+		return errors.New("server has no handler")
+	}
+	s.serving = true
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	// every socket is served on its own but all of them answer the same way
+	for _, udpConn := range s.listeners.udp {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveUDP(udpConn)
+		}()
+	}
+	for _, tcpListener := range s.listeners.tcp {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveTCP(tcpListener)
+		}()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	return errors.New("all sockets stopped without Shutdown")
+}
+
+// Shutdown stops reading new queries and waits until the ones already read get their answers
+// when ctx is done first handlers are cancelled, connections closed and ctx error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+
+	var errs []error
+	if s.listeners != nil {
+		// UDP socket is still needed to send answers for queries in progress
+		// so instead of closing it only the read is woken up - serveUDP stops on it
+		for _, udpConn := range s.listeners.udp {
+			errs = append(errs, udpConn.SetReadDeadline(time.Now()))
+		}
+		for _, tcpListener := range s.listeners.tcp {
+			errs = append(errs, tcpListener.Close())
+		}
+	}
+	// idle connections are waiting for the next query - waking up the read makes them close
+	for conn := range s.tcpConns {
+		errs = append(errs, conn.SetReadDeadline(time.Now()))
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var shutdownErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		shutdownErr = ctx.Err()
+
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		for conn := range s.tcpConns {
+			errs = append(errs, conn.Close())
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners != nil {
+		for _, udpConn := range s.listeners.udp {
+			errs = append(errs, udpConn.Close())
+		}
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if shutdownErr != nil {
+		return shutdownErr
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Reads queries from the socket and handles each one in its own goroutine
+// so a slow resolver answer for one client doesn't make everyone else wait
+// at most MaxInFlight queries are handled at the same time - when all slots are taken we stop reading
+// and new queries wait in the socket buffer (or get dropped by the kernel when it's full)
+// returns when reading from the socket fails - after Shutdown or because it was closed
+func (s *Server) serveUDP(udpConn *net.UDPConn) {
+	inFlight := make(chan struct{}, cmp.Or(s.MaxInFlight, defaultMaxInFlight))
+	var wg sync.WaitGroup
+
+	for {
+		inFlight <- struct{}{}
+
+		// every query gets its own buffer - the previous one can still be in use by its goroutine
+		// we don't know how big the query is before reading it so buffer fits the biggest payload we advertise
+		buf := make([]byte, EDNSUDPPayloadSize)
+
+		size, source, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			<-inFlight
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				fmt.Println("Error receiving data:", err)
+			}
+			break
+		}
+
+		fmt.Printf("Received %d bytes from %s\n", size, source)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			response := handlePacket(s.ctx, s.Handler, buf[:size], transportUDP, source)
+			if response == nil {
+				return
+			}
+
+			_, err := udpConn.WriteToUDP(response, source)
+			if err != nil {
+				fmt.Printf("Failed to send response: %v\n", err)
+			}
+		}()
+	}
+
+	// queries that were already read still get their answers handled before we return
+	wg.Wait()
+}
+
+// Turns a single packet into response bytes
+// every query that we can read gets an answer - if not with records then at least with rcode explaining why
+// returns nil only when there is no one to answer - packet is too short to have a header or it's not a query
+// transport decides how big the response can be - see encodeWithinLimit
+func handlePacket(ctx context.Context, handler Handler, packet []byte, t transport, remote net.Addr) []byte {
+	receivedMessage := DNSMessage{}
+	err := receivedMessage.Decode(packet)
+	if err != nil {
+		fmt.Printf("Couldn't decode message: %v\n", err)
+
+		// if at least the header is readable we can tell the client what's wrong using the same ID
+		header := DNSHeader{}
+		if header.Decode(packet) != nil || header.FLAGS.GetQR() {
+			return nil
+		}
+		return generateErrorResponse(DNSMessage{Header: header}, RcodeFormatError, maxResponseSize(DNSMessage{}, t))
+	}
+
+	maxSize := maxResponseSize(receivedMessage, t)
+
+	// someone sent us a response - answering it could start an endless ping pong between two servers
+	if receivedMessage.Header.FLAGS.GetQR() {
+		fmt.Println("Ignoring message that is not a query")
+		return nil
+	}
+
+	if hasUnsupportedEDNSVersion(receivedMessage) {
+		// nothing to resolve encodeResponse will answer with BADVERS
+		return generateErrorResponse(receivedMessage, RcodeSuccess, maxSize)
+	}
+
+	rcode, reason := queryPolicy(receivedMessage)
+	if rcode != RcodeSuccess {
+		fmt.Printf("Answering with rcode %d: %s\n", rcode, reason)
+		return generateErrorResponse(receivedMessage, rcode, maxSize)
+	}
+
+	w := &responseWriter{request: receivedMessage, remote: remote, maxSize: maxSize}
+	handler.ServeDNS(ctx, w, &receivedMessage)
+	if w.response == nil {
+		// half of the answers is worse than no answers - client should retry or ask someone else
+		fmt.Println("Handler didn't write a response, answering with SERVFAIL")
+		return generateErrorResponse(receivedMessage, RcodeServerFailure, maxSize)
+	}
+
+	return w.response
+}
+
+// NewResponse creates a response to req with the same ID, opcode, RD and questions
+// rcode is NOERROR - handler changes it if needed and adds the records
+func NewResponse(req *DNSMessage) *DNSMessage {
+	response := &DNSMessage{
+		Header:    DNSHeader{ID: req.Header.ID},
+		Questions: req.Questions,
+	}
+
+	//TODO: hide the complexity of what QR means and just create a flag IS this response or query
+	response.Header.FLAGS.SetQR(true)
+	// opcode comes from a decoded header so it always fits into 4 bits
+	_ = response.Header.FLAGS.SetOpCode(req.Header.FLAGS.GetOpCode())
+	response.Header.FLAGS.SetRD(req.Header.FLAGS.GetRD())
+
+	return response
+}
+
+// response without any records - only questions are echoed back so client can match it with the query
+func generateErrorResponse(receivedMessage DNSMessage, rcode uint16, maxSize int) []byte {
+	response := NewResponse(&receivedMessage)
+
+	// what went wrong is decided by the caller - see queryPolicy and handlePacket
+	err := response.Header.FLAGS.SetRcode(rcode)
+	if err != nil {
+		fmt.Printf("Error when generating error response: %v\n", err)
+		return nil
+	}
+
+	encoded, err := encodeResponse(receivedMessage, *response, maxSize)
+	if err != nil {
+		fmt.Printf("Error when generating error response: %v\n", err)
+		return nil
+	}
+	return encoded
+}
+
+// sets OPT matching the query and encodes the response trimmed to maxSize - see encodeWithinLimit
+func encodeResponse(receivedMessage DNSMessage, responseMessage DNSMessage, maxSize int) ([]byte, error) {
+	err := setResponseOPT(receivedMessage, &responseMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set OPT: %w", err)
+	}
+
+	response, err := encodeWithinLimit(&responseMessage, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode response: %w", err)
+	}
+	return response, nil
+}
+
+// OPT is hop by hop - whatever came from resolver is replaced by our own (options included)
+// and it's only added when client sent OPT https://www.rfc-editor.org/rfc/rfc6891#section-7
+func setResponseOPT(receivedMessage DNSMessage, responseMessage *DNSMessage) error {
+	requestOPT, err := receivedMessage.OPT()
+	if err != nil {
+		return err
+	}
+
+	if requestOPT == nil {
+		return responseMessage.SetOPT(nil)
+	}
+
+	responseOPT := &OPTRecord{
+		UDPPayloadSize: EDNSUDPPayloadSize,
+		DO:             requestOPT.DO,
+	}
+
+	if requestOPT.Version != 0 {
+		// we only know version 0 - answer BADVERS with no data https://www.rfc-editor.org/rfc/rfc6891#section-6.1.3
+		responseOPT.ExtendedRcode = uint8(RcodeBadVersion >> 4)
+		responseMessage.Answers = nil
+		responseMessage.Authority = nil
+		responseMessage.Additional = nil
+	}
+
+	return responseMessage.SetOPT(responseOPT)
+}
+
+func hasUnsupportedEDNSVersion(receivedMessage DNSMessage) bool {
+	opt, err := receivedMessage.OPT()
+	return err == nil && opt != nil && opt.Version != 0
+}
+
+// handlers log failed writes - there is nothing else they can do about it, client will retry
+func writeResponse(w ResponseWriter, response *DNSMessage) {
+	err := w.WriteMsg(response)
+	if err != nil {
+		fmt.Printf("Error when writing response: %v\n", err)
+	}
+}
@@ -0,0 +1,487 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQuery(t *testing.T, opt *OPTRecord) DNSMessage {
+	query := DNSMessage{
+		Header: DNSHeader{ID: 1234, QDCOUNT: 1},
+		Questions: []DNSQuestion{
+			{Name: EncodeName("mfranc.com"), Type: TypeA, Class: ClassIN},
+		},
+	}
+	query.Header.FLAGS.SetRD(true)
+
+	if opt != nil {
+		err := query.SetOPT(opt)
+		assert.NoError(t, err)
+		query.Header.ARCOUNT = 1
+	}
+	return query
+}
+
+func decodeTestResponse(t *testing.T, response []byte) DNSMessage {
+	decoded := DNSMessage{}
+	err := decoded.Decode(response)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func TestEncodeResponseWithoutEDNS(t *testing.T) {
+	query := newTestQuery(t, nil)
+
+	answers, err := generateLocalResponse(query)
+	assert.NoError(t, err)
+
+	responseMessage := NewResponse(&query)
+	responseMessage.Answers = answers
+	response, err := encodeResponse(query, *responseMessage, DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, response)
+	opt, err := decoded.OPT()
+	assert.NoError(t, err)
+	assert.Nil(t, opt)
+	assert.Equal(t, uint16(1), decoded.Header.ANCOUNT)
+	assert.Equal(t, uint16(0), decoded.Header.ARCOUNT)
+}
+
+func TestEncodeResponseEchoesOPT(t *testing.T) {
+	query := newTestQuery(t, &OPTRecord{UDPPayloadSize: 1232, DO: true})
+
+	answers, err := generateLocalResponse(query)
+	assert.NoError(t, err)
+
+	// OPT from resolver is replaced with ours - its options were meant for us and not the client
+	resolverOPT, err := (&OPTRecord{UDPPayloadSize: 512, Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}).ToAnswer()
+	assert.NoError(t, err)
+
+	responseMessage := NewResponse(&query)
+	responseMessage.Answers = answers
+	responseMessage.Additional = []DNSAnswer{resolverOPT}
+	response, err := encodeResponse(query, *responseMessage, DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, response)
+	assert.Equal(t, uint16(1), decoded.Header.ARCOUNT)
+
+	opt, err := decoded.OPT()
+	assert.NoError(t, err)
+	assert.Equal(t, &OPTRecord{
+		UDPPayloadSize: EDNSUDPPayloadSize,
+		DO:             true,
+	}, opt)
+	assert.Equal(t, uint16(0), decoded.Rcode())
+}
+
+func TestEncodeResponseBadVersion(t *testing.T) {
+	query := newTestQuery(t, &OPTRecord{UDPPayloadSize: 1232, Version: 1})
+	assert.True(t, hasUnsupportedEDNSVersion(query))
+
+	response, err := encodeResponse(query, *NewResponse(&query), DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, response)
+	assert.Equal(t, RcodeBadVersion, decoded.Rcode())
+	assert.Equal(t, 0, len(decoded.Answers))
+}
+
+// resolver listening on a random local port - every query is decoded and answered with respond
+// nil response means the resolver ignores the query
+func startFakeResolver(t *testing.T, respond func(query DNSMessage) *DNSMessage) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, EDNSUDPPayloadSize)
+		for {
+			size, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			query := DNSMessage{}
+			if err := query.Decode(buf[:size]); err != nil {
+				continue
+			}
+
+			// each query in its own goroutine so slow answers don't block the fast ones
+			go func() {
+				response := respond(query)
+				if response == nil {
+					return
+				}
+				encoded, err := response.Encode()
+				if err != nil {
+					return
+				}
+				_, _ = conn.WriteToUDP(encoded, source)
+			}()
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func newTestUpstream(t *testing.T, respond func(query DNSMessage) *DNSMessage) *Upstream {
+	conn, err := net.DialUDP("udp", nil, startFakeResolver(t, respond))
+	assert.NoError(t, err)
+
+	upstream := NewUpstream(conn)
+	t.Cleanup(func() { upstream.Close() })
+	return upstream
+}
+
+// response with the same ID and question as the query
+func newTestResponse(query DNSMessage) *DNSMessage {
+	response := &DNSMessage{
+		Header:    DNSHeader{ID: query.Header.ID, QDCOUNT: uint16(len(query.Questions))},
+		Questions: query.Questions,
+	}
+	response.Header.FLAGS.SetQR(true)
+	return response
+}
+
+func encodeTestQuery(t *testing.T, query DNSMessage) []byte {
+	encoded, err := query.Encode()
+	assert.NoError(t, err)
+	return encoded
+}
+
+func TestHandlePacketLocal(t *testing.T) {
+	query := newTestQuery(t, nil)
+
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, query.Header.ID, decoded.Header.ID)
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.True(t, decoded.Header.FLAGS.GetQR())
+	assert.Equal(t, query.Questions, decoded.Questions)
+	assert.Equal(t, 1, len(decoded.Answers))
+}
+
+func TestHandlePacketFormatError(t *testing.T) {
+	query := newTestQuery(t, nil)
+	encoded := encodeTestQuery(t, query)
+
+	// header says there is a question but the question is cut in half
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encoded[:HeaderSize+4], transportUDP, nil))
+	assert.Equal(t, query.Header.ID, decoded.Header.ID)
+	assert.Equal(t, RcodeFormatError, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, 0, len(decoded.Questions))
+	assert.Equal(t, 0, len(decoded.Answers))
+
+	// query without any questions
+	query.Questions = nil
+	query.Header.QDCOUNT = 0
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeFormatError, decoded.Header.FLAGS.GetRcode())
+
+	// not even a header - there is no ID to answer to
+	assert.Nil(t, handlePacket(context.Background(), LocalHandler{}, encoded[:HeaderSize-1], transportUDP, nil))
+}
+
+func TestHandlePacketNotImplemented(t *testing.T) {
+	query := newTestQuery(t, nil)
+	err := query.Header.FLAGS.SetOpCode(2) // STATUS
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, query.Header.ID, decoded.Header.ID)
+	assert.Equal(t, RcodeNotImplemented, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, uint16(2), decoded.Header.FLAGS.GetOpCode())
+	assert.Equal(t, 0, len(decoded.Answers))
+}
+
+func TestHandlePacketRefused(t *testing.T) {
+	// CHAOS class - version.bind style query
+	query := newTestQuery(t, nil)
+	query.Questions[0].Class = 3
+
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeRefused, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, 0, len(decoded.Answers))
+
+	query = newTestQuery(t, nil)
+	query.Questions[0].Type = TypeAXFR
+
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeRefused, decoded.Header.FLAGS.GetRcode())
+}
+
+func TestHandlePacketIgnoresResponses(t *testing.T) {
+	query := newTestQuery(t, nil)
+	query.Header.FLAGS.SetQR(true)
+
+	assert.Nil(t, handlePacket(context.Background(), LocalHandler{}, encodeTestQuery(t, query), transportUDP, nil))
+}
+
+// listens on the addresses of the server and serves until the test ends
+func startTestServer(t *testing.T, server *Server) []net.Addr {
+	err := server.Listen()
+	assert.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		assert.ErrorIs(t, <-served, ErrServerClosed)
+	})
+
+	return server.LocalAddrs()
+}
+
+func exchangeTestUDP(t *testing.T, addr net.Addr, query DNSMessage) DNSMessage {
+	client, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write(encodeTestQuery(t, query))
+	assert.NoError(t, err)
+
+	err = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+	buf := make([]byte, EDNSUDPPayloadSize)
+	size, err := client.Read(buf)
+	assert.NoError(t, err)
+
+	return decodeTestResponse(t, buf[:size])
+}
+
+func TestHandlePacketHandlerWithoutResponse(t *testing.T) {
+	silent := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *DNSMessage) {})
+
+	query := newTestQuery(t, nil)
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), silent, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, query.Header.ID, decoded.Header.ID)
+	assert.Equal(t, RcodeServerFailure, decoded.Header.FLAGS.GetRcode())
+}
+
+func TestResponseWriterWritesOnce(t *testing.T) {
+	query := newTestQuery(t, nil)
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	w := &responseWriter{request: query, remote: remote, maxSize: DefaultUDPPayloadSize}
+
+	assert.NoError(t, w.WriteMsg(NewResponse(&query)))
+	assert.Error(t, w.WriteMsg(NewResponse(&query)))
+	assert.Equal(t, remote, w.RemoteAddr())
+}
+
+func TestNewResponse(t *testing.T) {
+	query := newTestQuery(t, nil)
+	err := query.Header.FLAGS.SetOpCode(2)
+	assert.NoError(t, err)
+
+	response := NewResponse(&query)
+	assert.Equal(t, query.Header.ID, response.Header.ID)
+	assert.True(t, response.Header.FLAGS.GetQR())
+	assert.True(t, response.Header.FLAGS.GetRD())
+	assert.Equal(t, uint16(2), response.Header.FLAGS.GetOpCode())
+	assert.Equal(t, RcodeSuccess, response.Header.FLAGS.GetRcode())
+	assert.Equal(t, query.Questions, response.Questions)
+}
+
+// server started in process answers with its own handler over UDP and TCP
+func TestServerListenAndServe(t *testing.T) {
+	hello := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+		response := NewResponse(req)
+		answer, err := NewAnswer("mfranc.com", ClassIN, 60, &RDataTXT{Texts: []string{"hello " + w.RemoteAddr().Network()}})
+		assert.NoError(t, err)
+		response.Answers = []DNSAnswer{answer}
+		assert.NoError(t, w.WriteMsg(response))
+	})
+
+	addrs := startTestServer(t, &Server{Addrs: []string{"127.0.0.1:0"}, Handler: hello})
+	assert.Equal(t, 2, len(addrs))
+
+	response := exchangeTestUDP(t, addrs[0], newTestQuery(t, nil))
+	rdata, err := response.Answers[0].RData()
+	assert.NoError(t, err)
+	assert.Equal(t, &RDataTXT{Texts: []string{"hello udp"}}, rdata)
+
+	conn, err := net.Dial("tcp", addrs[1].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	err = WriteTCPMessage(conn, encodeTestQuery(t, newTestQuery(t, nil)))
+	assert.NoError(t, err)
+	message, err := ReadTCPMessage(conn)
+	assert.NoError(t, err)
+
+	response = decodeTestResponse(t, message)
+	rdata, err = response.Answers[0].RData()
+	assert.NoError(t, err)
+	assert.Equal(t, &RDataTXT{Texts: []string{"hello tcp"}}, rdata)
+}
+
+func TestServerErrors(t *testing.T) {
+	server := &Server{Addrs: []string{"udp://127.0.0.1:0"}}
+	assert.Error(t, server.Serve())
+
+	assert.NoError(t, server.Listen())
+	assert.Error(t, server.Listen())
+	// there is no handler
+	assert.Error(t, server.Serve())
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.ErrorIs(t, server.Listen(), ErrServerClosed)
+	assert.ErrorIs(t, server.Serve(), ErrServerClosed)
+	assert.ErrorIs(t, server.Shutdown(context.Background()), ErrServerClosed)
+
+	server = &Server{Addrs: []string{"bad"}}
+	assert.Error(t, server.Listen())
+}
+
+// query that is already being handled gets its answer even though server is shutting down
+func TestServerShutdownWaitsForQueriesInProgress(t *testing.T) {
+	started := make(chan struct{})
+	slow := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		writeResponse(w, NewResponse(req))
+	})
+
+	server := &Server{Addrs: []string{"udp://127.0.0.1:0"}, Handler: slow}
+	assert.NoError(t, server.Listen())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	client, err := net.DialUDP("udp", nil, server.LocalAddrs()[0].(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(encodeTestQuery(t, newTestQuery(t, nil)))
+	assert.NoError(t, err)
+
+	<-started
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+
+	err = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+	buf := make([]byte, EDNSUDPPayloadSize)
+	size, err := client.Read(buf)
+	assert.NoError(t, err)
+	response := decodeTestResponse(t, buf[:size])
+	assert.Equal(t, RcodeSuccess, response.Header.FLAGS.GetRcode())
+}
+
+// connection waiting for the next query doesn't hold the shutdown until its idle timeout
+func TestServerShutdownClosesIdleTCPConnections(t *testing.T) {
+	server := &Server{Addrs: []string{"tcp://127.0.0.1:0"}, Handler: LocalHandler{}, TCPIdleTimeout: time.Minute}
+	assert.NoError(t, server.Listen())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", server.LocalAddrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// answered query makes sure the connection is already served
+	err = WriteTCPMessage(conn, encodeTestQuery(t, newTestQuery(t, nil)))
+	assert.NoError(t, err)
+	_, err = ReadTCPMessage(conn)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+	assert.Less(t, time.Since(start), time.Second)
+
+	_, err = ReadTCPMessage(conn)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// handler that doesn't finish in time is cancelled and Shutdown reports it
+func TestServerShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	stuck := HandlerFunc(func(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	server := &Server{Addrs: []string{"udp://127.0.0.1:0"}, Handler: stuck}
+	assert.NoError(t, server.Listen())
+	go func() {
+		_ = server.Serve()
+	}()
+
+	client, err := net.DialUDP("udp", nil, server.LocalAddrs()[0].(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(encodeTestQuery(t, newTestQuery(t, nil)))
+	assert.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
+
+// slow resolver answer for one client shouldn't block the other clients
+func TestServeUDPHandlesQueriesConcurrently(t *testing.T) {
+	slowName := EncodeName("slow.mfranc.com")
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		if bytes.Equal(query.Questions[0].Name, slowName) {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return newTestResponse(query)
+	})
+
+	addrs := startTestServer(t, &Server{Addrs: []string{"udp://127.0.0.1:0"}, Handler: NewForwardingHandler(upstream), MaxInFlight: 10})
+
+	client, err := net.DialUDP("udp", nil, addrs[0].(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	slowQuery := newTestQuery(t, nil)
+	slowQuery.Header.ID = 1
+	slowQuery.Questions[0].Name = slowName
+	fastQuery := newTestQuery(t, nil)
+	fastQuery.Header.ID = 2
+
+	start := time.Now()
+	_, err = client.Write(encodeTestQuery(t, slowQuery))
+	assert.NoError(t, err)
+	_, err = client.Write(encodeTestQuery(t, fastQuery))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 512)
+	err = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+
+	size, err := client.Read(buf)
+	assert.NoError(t, err)
+	first := decodeTestResponse(t, buf[:size])
+	assert.Equal(t, uint16(2), first.Header.ID, "fast query should be answered first")
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+
+	size, err = client.Read(buf)
+	assert.NoError(t, err)
+	second := decodeTestResponse(t, buf[:size])
+	assert.Equal(t, uint16(1), second.Header.ID)
+}
@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SplitResolver sends questions to different resolvers depending on the name (split DNS)
+// so one server can answer both internal names (from internal resolver) and public ones
+// rule with the longest suffix wins - suffix has to match whole labels so corp.example
+// matches corp.example and www.corp.example but not notcorp.example
+// names that don't match any rule go to the fallback resolver
+type SplitResolver struct {
+	fallback Resolver
+	// lowercase encoded suffix => resolver
+	routes map[string]Resolver
+}
+
+// NewSplitResolver creates resolver sending everything to fallback until routes are added
+func NewSplitResolver(fallback Resolver) *SplitResolver {
+	return &SplitResolver{fallback: fallback, routes: map[string]Resolver{}}
+}
+
+// Route sends questions for the suffix and names below it to the resolver
+// can be called only before the first Exchange
+func (s *SplitResolver) Route(suffix string, resolver Resolver) error {
+	suffix = strings.TrimSuffix(suffix, ".")
+	if suffix == "" {
+		return fmt.Errorf("suffix can't be empty - names without a rule go to the fallback resolver")
+	}
+	for _, label := range splitName(suffix) {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid suffix %q: labels have to be 1 to 63 characters long", suffix)
+		}
+	}
+
+	s.routes[strings.ToLower(string(EncodeName(suffix)))] = resolver
+	return nil
+}
+
+// Exchange passes the query to the resolver picked by the name in its only question
+func (s *SplitResolver) Exchange(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	if len(query.Questions) != 1 {
+		return DNSMessage{}, fmt.Errorf("upstream query has to have exactly one question got: %d", len(query.Questions))
+	}
+	return s.resolverFor(query.Questions[0].Name).Exchange(ctx, query)
+}
+
+// suffixes are checked from the whole name to the last label so the first match is the longest one
+func (s *SplitResolver) resolverFor(name []byte) Resolver {
+	name = bytes.ToLower(name)
+	for offset := 0; offset < len(name) && name[offset] != 0; offset += int(name[offset]) + 1 {
+		if resolver, ok := s.routes[string(name[offset:])]; ok {
+			return resolver
+		}
+	}
+	return s.fallback
+}
@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resolver telling which one it is - only compared, never asked
+type namedTestResolver string
+
+func (namedTestResolver) Exchange(context.Context, DNSMessage) (DNSMessage, error) {
+	return DNSMessage{}, nil
+}
+
+func TestSplitResolverLongestSuffix(t *testing.T) {
+	split := NewSplitResolver(namedTestResolver("fallback"))
+	assert.NoError(t, split.Route("corp.example", namedTestResolver("corp")))
+	assert.NoError(t, split.Route("dev.corp.example.", namedTestResolver("dev")))
+	assert.NoError(t, split.Route("Consul", namedTestResolver("consul")))
+
+	tests := []struct {
+		name     string
+		resolver Resolver
+	}{
+		{"corp.example", namedTestResolver("corp")},
+		{"www.corp.example", namedTestResolver("corp")},
+		{"WWW.Corp.Example", namedTestResolver("corp")},
+		{"dev.corp.example", namedTestResolver("dev")},
+		{"api.dev.corp.example", namedTestResolver("dev")},
+		{"web.service.consul", namedTestResolver("consul")},
+		// only whole labels match
+		{"notcorp.example", namedTestResolver("fallback")},
+		{"example", namedTestResolver("fallback")},
+		{"mfranc.com", namedTestResolver("fallback")},
+		{"", namedTestResolver("fallback")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.resolver, split.resolverFor(EncodeName(test.name)))
+		})
+	}
+}
+
+func TestSplitResolverRouteErrors(t *testing.T) {
+	split := NewSplitResolver(namedTestResolver("fallback"))
+	assert.Error(t, split.Route("", namedTestResolver("root")))
+	assert.Error(t, split.Route(".", namedTestResolver("root")))
+	assert.Error(t, split.Route("corp..example", namedTestResolver("corp")))
+	assert.Error(t, split.Route(string(make([]byte, 64))+".example", namedTestResolver("corp")))
+}
+
+func TestSplitResolverExchange(t *testing.T) {
+	var fallbackQueries, corpQueries atomic.Int32
+	fallback := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		fallbackQueries.Add(1)
+		return newTestResponse(query)
+	})
+	corp := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		corpQueries.Add(1)
+		return newTestResponse(query)
+	})
+
+	split := NewSplitResolver(fallback)
+	assert.NoError(t, split.Route("corp.example", corp))
+
+	query := DNSMessage{
+		Header:    DNSHeader{QDCOUNT: 1},
+		Questions: []DNSQuestion{{Name: EncodeName("www.corp.example"), Type: TypeA, Class: ClassIN}},
+	}
+	_, err := split.Exchange(context.Background(), query)
+	assert.NoError(t, err)
+
+	query.Questions[0].Name = EncodeName("mfranc.com")
+	_, err = split.Exchange(context.Background(), query)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(1), corpQueries.Load())
+	assert.Equal(t, int32(1), fallbackQueries.Load())
+
+	_, err = split.Exchange(context.Background(), DNSMessage{})
+	assert.Error(t, err)
+}
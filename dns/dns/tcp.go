@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// https://www.rfc-editor.org/rfc/rfc7766
+// over TCP every message is prefixed with 2 bytes of its length - messages can be up to 65535 bytes
+// client can send many queries one after another without waiting (pipelining) and answers can come back in any order
+// connection without any new query for idle timeout is closed - https://www.rfc-editor.org/rfc/rfc7766#section-6.2.3
+
+// queries from a single connection handled at the same time - next ones wait until one of them is answered
+const maxPipelinedQueries = 32
+
+// Accepts connections and serves each one in its own goroutine
+// at most TCPConnections are served at the same time - connections above the limit are closed right away
+// so the client can retry later or go to another server instead of waiting
+// returns when the listener is closed and all of its connections are done
+func (s *Server) serveTCP(listener net.Listener) {
+	connections := make(chan struct{}, cmp.Or(s.TCPConnections, defaultTCPConnections))
+	var wg sync.WaitGroup
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			fmt.Println("Error accepting TCP connection:", err)
+			continue
+		}
+
+		select {
+		case connections <- struct{}{}:
+		default:
+			fmt.Println("Too many TCP connections, closing connection from", conn.RemoteAddr())
+			closeTCPConnection(conn)
+			continue
+		}
+
+		if !s.trackTCPConnection(conn) {
+			// Shutdown started between accept and here
+			<-connections
+			closeTCPConnection(conn)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-connections }()
+			defer s.untrackTCPConnection(conn)
+
+			s.handleTCPConnection(conn)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Reads queries from a single connection until client closes it, it's idle for longer than TCPIdleTimeout
+// or Shutdown is called - every query is handled in its own goroutine so one slow answer doesn't hold the ones behind it
+func (s *Server) handleTCPConnection(conn net.Conn) {
+	idleTimeout := cmp.Or(s.TCPIdleTimeout, defaultTCPIdleTimeout)
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	pipeline := make(chan struct{}, maxPipelinedQueries)
+
+	// defers run in reverse so queries that are in progress get their answers written before we close
+	defer closeTCPConnection(conn)
+	defer wg.Wait()
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err != nil {
+			fmt.Println("Failed to set TCP read deadline:", err)
+			return
+		}
+
+		// checked after setting the deadline as it would override the one Shutdown sets to wake up the read
+		if s.shuttingDown() {
+			return
+		}
+
+		packet, err := ReadTCPMessage(conn)
+		if err != nil {
+			// client closing the connection or going idle is the normal way for it to end
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Printf("Error receiving data from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		fmt.Printf("Received %d bytes over TCP from %s\n", len(packet), conn.RemoteAddr())
+
+		pipeline <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-pipeline }()
+
+			response := handlePacket(s.ctx, s.Handler, packet, transportTCP, conn.RemoteAddr())
+			if response == nil {
+				return
+			}
+
+			// responses from different goroutines can't be interleaved on the wire
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			err := conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			if err == nil {
+				err = WriteTCPMessage(conn, response)
+			}
+			if err != nil {
+				fmt.Printf("Failed to send response over TCP: %v\n", err)
+			}
+		}()
+	}
+}
+
+// connections are tracked so Shutdown can wake up the ones waiting for the next query
+// returns false when Shutdown already started and the connection shouldn't be served
+func (s *Server) trackTCPConnection(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.tcpConns == nil {
+		s.tcpConns = map[net.Conn]struct{}{}
+	}
+	s.tcpConns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackTCPConnection(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tcpConns, conn)
+}
+
+// ReadTCPMessage reads one length prefixed message - see WriteTCPMessage
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, message)
+	if err != nil {
+		// connection closed in the middle of the message
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// WriteTCPMessage writes message prefixed with 2 bytes of its length as it's sent over TCP
+func WriteTCPMessage(w io.Writer, message []byte) error {
+	if len(message) > maxTCPMessageSize {
+		return fmt.Errorf("message of %d bytes doesn't fit into TCP length prefix", len(message))
+	}
+
+	// length and message go in one write so they end up in one segment
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+
+	_, err := w.Write(framed)
+	return err
+}
+
+func closeTCPConnection(conn net.Conn) {
+	err := conn.Close()
+	if err != nil {
+		fmt.Println("Failed to close tcp connection", err)
+		// this usually will happen when file is already closed so no need to retry
+	}
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestTCPServer(t *testing.T, maxConnections int, idleTimeout time.Duration, handler Handler) string {
+	addrs := startTestServer(t, &Server{
+		Addrs:          []string{"tcp://127.0.0.1:0"},
+		Handler:        handler,
+		TCPConnections: maxConnections,
+		TCPIdleTimeout: idleTimeout,
+	})
+	return addrs[0].String()
+}
+
+func TestTCPMessageFraming(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	err := WriteTCPMessage(buf, []byte{1, 2, 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 3, 1, 2, 3}, buf.Bytes())
+
+	message, err := ReadTCPMessage(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, message)
+
+	_, err = ReadTCPMessage(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// length says 5 but only 2 bytes follow
+	_, err = ReadTCPMessage(bytes.NewBuffer([]byte{0, 5, 1, 2}))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	err = WriteTCPMessage(buf, make([]byte, 0x10000))
+	assert.Error(t, err)
+}
+
+// two queries written at once before reading anything - both have to be answered on the same connection
+func TestServeTCPPipelinedQueries(t *testing.T) {
+	addr := startTestTCPServer(t, 10, time.Second, LocalHandler{})
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	pipelined := new(bytes.Buffer)
+	for _, id := range []uint16{1, 2} {
+		query := newTestQuery(t, nil)
+		query.Header.ID = id
+		err = WriteTCPMessage(pipelined, encodeTestQuery(t, query))
+		assert.NoError(t, err)
+	}
+	_, err = conn.Write(pipelined.Bytes())
+	assert.NoError(t, err)
+
+	err = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+
+	// answers can come in any order
+	ids := map[uint16]bool{}
+	for range 2 {
+		message, err := ReadTCPMessage(conn)
+		assert.NoError(t, err)
+
+		response := decodeTestResponse(t, message)
+		assert.Equal(t, RcodeSuccess, response.Header.FLAGS.GetRcode())
+		assert.Equal(t, 1, len(response.Answers))
+		ids[response.Header.ID] = true
+	}
+	assert.Equal(t, map[uint16]bool{1: true, 2: true}, ids)
+}
+
+func TestServeTCPIdleTimeout(t *testing.T) {
+	addr := startTestTCPServer(t, 10, 100*time.Millisecond, LocalHandler{})
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+
+	// server closes the connection after idle timeout without us sending anything
+	start := time.Now()
+	_, err = ReadTCPMessage(conn)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestServeTCPConnectionLimit(t *testing.T) {
+	addr := startTestTCPServer(t, 1, time.Second, LocalHandler{})
+
+	first, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer first.Close()
+
+	// make sure the first connection is accepted and holds the only slot
+	err = WriteTCPMessage(first, encodeTestQuery(t, newTestQuery(t, nil)))
+	assert.NoError(t, err)
+	_, err = ReadTCPMessage(first)
+	assert.NoError(t, err)
+
+	second, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer second.Close()
+
+	err = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, err)
+	_, err = ReadTCPMessage(second)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeTCPForwardsToResolver(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.ParseIP("10.0.0.1")})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+	addr := startTestTCPServer(t, 10, time.Second, NewForwardingHandler(upstream))
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	query := newTestQuery(t, nil)
+	err = WriteTCPMessage(conn, encodeTestQuery(t, query))
+	assert.NoError(t, err)
+
+	message, err := ReadTCPMessage(conn)
+	assert.NoError(t, err)
+
+	response := decodeTestResponse(t, message)
+	assert.Equal(t, query.Header.ID, response.Header.ID)
+	rdata, err := response.Answers[0].RData()
+	assert.NoError(t, err)
+	assert.Equal(t, &RDataA{IP: net.ParseIP("10.0.0.1").To4()}, rdata)
+}
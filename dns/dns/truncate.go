@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// transport the query came over - it decides how big the response can be
+type transport int
+
+const (
+	transportUDP transport = iota
+	transportTCP
+)
+
+// biggest message that fits into the 2 byte length prefix used over TCP
+const maxTCPMessageSize = 0xFFFF
+
+// over UDP response can't be bigger than what client advertised in OPT (or 512 without it)
+// over TCP only the length prefix limits it
+func maxResponseSize(receivedMessage DNSMessage, t transport) int {
+	if t == transportTCP {
+		return maxTCPMessageSize
+	}
+	return receivedMessage.UDPPayloadSize()
+}
+
+// Encodes the message dropping whole RRsets from the end until it fits into maxSize
+// https://www.rfc-editor.org/rfc/rfc2181#section-9
+//   - additional records go first and without TC - they are only hints (glue) and client can ask for them
+//   - then authority and answers - these are part of the answer so TC is set and client should retry over TCP
+//
+// partial RRset is never sent - client could cache it as the full one
+// header counts are updated to what is left, OPT always stays as it tells the client our payload size
+func encodeWithinLimit(message *DNSMessage, maxSize int) ([]byte, error) {
+	for {
+		message.Header.QDCOUNT = uint16(len(message.Questions))
+		message.Header.ANCOUNT = uint16(len(message.Answers))
+		message.Header.NSCOUNT = uint16(len(message.Authority))
+		message.Header.ARCOUNT = uint16(len(message.Additional))
+
+		encoded, err := message.Encode()
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) <= maxSize {
+			return encoded, nil
+		}
+
+		switch {
+		case hasRecordsOtherThanOPT(message.Additional):
+			message.Additional = removeLastRRset(message.Additional)
+		case len(message.Authority) > 0:
+			message.Authority = removeLastRRset(message.Authority)
+			message.Header.FLAGS.SetTC(true)
+		case len(message.Answers) > 0:
+			message.Answers = removeLastRRset(message.Answers)
+			message.Header.FLAGS.SetTC(true)
+		default:
+			return nil, fmt.Errorf("response of %d bytes doesn't fit into %d even without records", len(encoded), maxSize)
+		}
+	}
+}
+
+func hasRecordsOtherThanOPT(records []DNSAnswer) bool {
+	for _, record := range records {
+		if record.Type != TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+// RRset is all the records with the same name, type and class - https://www.rfc-editor.org/rfc/rfc2181#section-5
+// records of one RRset don't have to be next to each other so the whole section is searched
+// OPT is skipped as it's not a real record
+func removeLastRRset(records []DNSAnswer) []DNSAnswer {
+	last := -1
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Type != TypeOPT {
+			last = i
+			break
+		}
+	}
+	if last == -1 {
+		return records
+	}
+
+	removed := records[last]
+	var kept []DNSAnswer
+	for _, record := range records {
+		sameRRset := record.Type == removed.Type && record.Class == removed.Class && bytes.EqualFold(record.Name, removed.Name)
+		if !sameRRset {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
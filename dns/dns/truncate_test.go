@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRRset(t *testing.T, name string, count int, rdata func(i int) RData) []DNSAnswer {
+	var records []DNSAnswer
+	for i := range count {
+		record, err := NewAnswer(name, ClassIN, 60, rdata(i))
+		assert.NoError(t, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+func newTestARRset(t *testing.T, name string, count int) []DNSAnswer {
+	return newTestRRset(t, name, count, func(i int) RData {
+		return &RDataA{IP: net.IPv4(10, 0, 0, byte(i))}
+	})
+}
+
+// two TXT records of 250 bytes - together with anything else they don't fit into 512
+func newTestTXTRRset(t *testing.T, name string) []DNSAnswer {
+	return newTestRRset(t, name, 2, func(i int) RData {
+		return &RDataTXT{Texts: []string{strings.Repeat("x", 250)}}
+	})
+}
+
+func TestEncodeWithinLimitFits(t *testing.T) {
+	message := newTestQuery(t, nil)
+	message.Answers = newTestARRset(t, "mfranc.com", 3)
+
+	encoded, err := encodeWithinLimit(&message, DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, encoded)
+	assert.False(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, uint16(3), decoded.Header.ANCOUNT)
+}
+
+func TestEncodeWithinLimitDropsWholeRRsets(t *testing.T) {
+	aRecords := newTestARRset(t, "a.mfranc.com", 5)
+	message := newTestQuery(t, nil)
+	message.Answers = append(append([]DNSAnswer{}, aRecords...), newTestTXTRRset(t, "b.mfranc.com")...)
+
+	encoded, err := encodeWithinLimit(&message, DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(encoded), DefaultUDPPayloadSize)
+
+	// TXT RRset is gone as a whole even though one of its records would fit
+	decoded := decodeTestResponse(t, encoded)
+	assert.True(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, uint16(5), decoded.Header.ANCOUNT)
+	assert.Equal(t, aRecords, decoded.Answers)
+}
+
+func TestEncodeWithinLimitDropsAdditionalWithoutTC(t *testing.T) {
+	message := newTestQuery(t, &OPTRecord{UDPPayloadSize: DefaultUDPPayloadSize})
+	message.Answers = newTestARRset(t, "mfranc.com", 2)
+	message.Additional = append(newTestTXTRRset(t, "glue.mfranc.com"), message.Additional...)
+
+	encoded, err := encodeWithinLimit(&message, DefaultUDPPayloadSize)
+	assert.NoError(t, err)
+
+	decoded := decodeTestResponse(t, encoded)
+	assert.False(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, 2, len(decoded.Answers))
+	// only OPT is left
+	assert.Equal(t, uint16(1), decoded.Header.ARCOUNT)
+	opt, err := decoded.OPT()
+	assert.NoError(t, err)
+	assert.NotNil(t, opt)
+}
+
+func TestEncodeWithinLimitTooSmall(t *testing.T) {
+	message := newTestQuery(t, nil)
+	message.Answers = newTestARRset(t, "mfranc.com", 1)
+
+	_, err := encodeWithinLimit(&message, HeaderSize)
+	assert.Error(t, err)
+}
+
+func TestRemoveLastRRset(t *testing.T) {
+	first := newTestARRset(t, "mfranc.com", 2)
+	other := newTestARRset(t, "other.mfranc.com", 1)
+	// the same RRset split in two places and with different case of the name
+	last := newTestARRset(t, "MFRANC.com", 1)
+
+	records := append(append(append([]DNSAnswer{}, first...), other...), last...)
+	assert.Equal(t, other, removeLastRRset(records))
+
+	opt, err := (&OPTRecord{UDPPayloadSize: EDNSUDPPayloadSize}).ToAnswer()
+	assert.NoError(t, err)
+	assert.Equal(t, []DNSAnswer{opt}, removeLastRRset(append(other, opt)))
+}
+
+// the same answer is truncated for a client without EDNS and sent whole to the one that can receive it
+func TestEncodeResponseTruncatesToPayloadSize(t *testing.T) {
+	answers := append(newTestARRset(t, "a.mfranc.com", 5), newTestTXTRRset(t, "b.mfranc.com")...)
+	newResponse := func(query DNSMessage) DNSMessage {
+		response := NewResponse(&query)
+		response.Answers = answers
+		return *response
+	}
+
+	query := newTestQuery(t, nil)
+	response, err := encodeResponse(query, newResponse(query), maxResponseSize(query, transportUDP))
+	assert.NoError(t, err)
+	decoded := decodeTestResponse(t, response)
+	assert.True(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, 5, len(decoded.Answers))
+
+	response, err = encodeResponse(query, newResponse(query), maxResponseSize(query, transportTCP))
+	assert.NoError(t, err)
+	decoded = decodeTestResponse(t, response)
+	assert.False(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, 7, len(decoded.Answers))
+
+	query = newTestQuery(t, &OPTRecord{UDPPayloadSize: 1232})
+	response, err = encodeResponse(query, newResponse(query), maxResponseSize(query, transportUDP))
+	assert.NoError(t, err)
+	decoded = decodeTestResponse(t, response)
+	assert.False(t, decoded.Header.FLAGS.GetTC())
+	assert.Equal(t, 7, len(decoded.Answers))
+}
@@ -0,0 +1,324 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUpstreamClosed = errors.New("upstream client closed")
+	// resolver didn't answer any of the attempts - this ends up as SERVFAIL for the client
+	ErrUpstreamTimeout = errors.New("upstream did not answer")
+)
+
+// RetryPolicy decides how many times and how long the query to the resolver is waited for
+// UDP can lose the query or the answer so we send the same query again if the answer doesn't come in time
+// every next attempt waits twice as long as the previous one (up to MaxAttemptTimeout)
+// and gets some random jitter added so many queries that failed together don't retry in lockstep
+type RetryPolicy struct {
+	Attempts          int
+	AttemptTimeout    time.Duration
+	MaxAttemptTimeout time.Duration
+	// fraction of the attempt timeout that can be added at random - 0.2 means up to 20% longer
+	Jitter float64
+}
+
+// DefaultRetryPolicy - 3 attempts waiting 1s, 2s and 4s plus up to 20% jitter
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:          3,
+		AttemptTimeout:    time.Second,
+		MaxAttemptTimeout: 5 * time.Second,
+		Jitter:            0.2,
+	}
+}
+
+// how long to wait for the answer after sending attempt number `attempt` (counting from 0)
+func (p RetryPolicy) timeout(attempt int) time.Duration {
+	timeout := p.AttemptTimeout
+	for range attempt {
+		timeout *= 2
+		if timeout >= p.MaxAttemptTimeout {
+			timeout = p.MaxAttemptTimeout
+			break
+		}
+	}
+
+	if p.Jitter > 0 {
+		timeout += time.Duration(rand.Float64() * p.Jitter * float64(timeout))
+	}
+	return timeout
+}
+
+// Response from the resolver is matched with the query by ID and question
+// ID alone is not enough - it's only 16 bits and guessing it is how cache poisoning works
+type pendingKey struct {
+	id    uint16
+	name  string
+	type_ uint16
+	class uint16
+}
+
+func newPendingKey(id uint16, question DNSQuestion) pendingKey {
+	return pendingKey{
+		id: id,
+		// resolvers are allowed to change the case of the name so we compare it case insensitive
+		name:  string(bytes.ToLower(question.Name)),
+		type_: question.Type,
+		class: question.Class,
+	}
+}
+
+// Resolver answers queries with exactly one question - implemented by Upstream and UpstreamPool
+type Resolver interface {
+	Exchange(ctx context.Context, query DNSMessage) (DNSMessage, error)
+}
+
+// Upstream is a client for a single resolver that many queries can use at the same time over one socket
+// every query gets random ID and waits in the in-flight table until response with the same ID
+// and question comes back - responses that don't match anything we asked are dropped
+type Upstream struct {
+	conn net.Conn
+	// can be changed only before the first Exchange
+	Retry RetryPolicy
+
+	mu      sync.Mutex
+	pending map[pendingKey]chan DNSMessage
+	closed  chan struct{}
+}
+
+// NewUpstream takes over the connection to the resolver - it is closed by Close
+func NewUpstream(conn net.Conn) *Upstream {
+	client := &Upstream{
+		conn:    conn,
+		Retry:   DefaultRetryPolicy(),
+		pending: map[pendingKey]chan DNSMessage{},
+		closed:  make(chan struct{}),
+	}
+
+	go client.readLoop()
+
+	return client
+}
+
+// Exchange sends a query with exactly one question and waits for the matching response
+// ID of the query is replaced with a random one so it doesn't matter what ID the caller used
+// query is sent again with the same ID when the answer doesn't come in time - see RetryPolicy
+// so a late answer to the earlier attempt is as good as the answer to the last one
+// truncated answer is asked for again over TCP - see exchangeTCP
+func (c *Upstream) Exchange(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	if len(query.Questions) != 1 {
+		return DNSMessage{}, fmt.Errorf("upstream query has to have exactly one question got: %d", len(query.Questions))
+	}
+
+	key, responses, err := c.register(query.Questions[0])
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	defer c.unregister(key)
+
+	fmt.Println("Sending message to resolver:  ", c)
+
+	query.Header.ID = key.id
+	encoded, err := query.Encode()
+	if err != nil {
+		return DNSMessage{}, fmt.Errorf("failed to encode query to resolver: %w", err)
+	}
+
+	var lastErr error
+	for attempt := range c.Retry.Attempts {
+		_, err = c.conn.Write(encoded)
+		if err != nil {
+			// connected UDP socket reports ICMP errors from earlier packets on write as well
+			// it's not a reason to give up - we wait for this attempt and try again
+			lastErr = fmt.Errorf("failed to send message to resolver: %w", err)
+			fmt.Printf("attempt %d: %v\n", attempt+1, lastErr)
+		}
+
+		timer := time.NewTimer(c.Retry.timeout(attempt))
+		select {
+		case response := <-responses:
+			timer.Stop()
+			if !response.Header.FLAGS.GetTC() {
+				return response, nil
+			}
+
+			fullResponse, err := c.exchangeTCP(ctx, encoded, key)
+			if err != nil {
+				// truncated answer is still better than none - TC is passed to the client so it can come back over TCP
+				fmt.Printf("failed to get truncated answer over TCP: %v\n", err)
+				return response, nil
+			}
+			return fullResponse, nil
+		case <-timer.C:
+			fmt.Printf("attempt %d: no answer from resolver for %s\n", attempt+1, DecodeName(query.Questions[0].Name))
+		case <-ctx.Done():
+			timer.Stop()
+			return DNSMessage{}, fmt.Errorf("waiting for resolver response: %w", ctx.Err())
+		case <-c.closed:
+			timer.Stop()
+			return DNSMessage{}, ErrUpstreamClosed
+		}
+	}
+
+	if lastErr != nil {
+		return DNSMessage{}, fmt.Errorf("no answer after %d attempts, last error %v: %w", c.Retry.Attempts, lastErr, ErrUpstreamTimeout)
+	}
+	return DNSMessage{}, fmt.Errorf("no answer after %d attempts: %w", c.Retry.Attempts, ErrUpstreamTimeout)
+}
+
+// Sends the query to the same resolver over TCP where the answer doesn't have to fit into UDP payload
+// https://www.rfc-editor.org/rfc/rfc7766#section-5 - new connection is used for every query
+// as truncated answers are rare enough that keeping connections open isn't worth it
+func (c *Upstream) exchangeTCP(ctx context.Context, encoded []byte, key pendingKey) (DNSMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Retry.MaxAttemptTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.conn.RemoteAddr().String())
+	if err != nil {
+		return DNSMessage{}, fmt.Errorf("failed to connect to resolver over TCP: %w", err)
+	}
+	defer conn.Close()
+
+	// closing the connection is the only way to interrupt blocked read when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = WriteTCPMessage(conn, encoded)
+	if err != nil {
+		return DNSMessage{}, fmt.Errorf("failed to send message to resolver over TCP: %w", err)
+	}
+
+	packet, err := ReadTCPMessage(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return DNSMessage{}, fmt.Errorf("waiting for resolver response over TCP: %w", ctx.Err())
+		}
+		return DNSMessage{}, fmt.Errorf("failed to read response from resolver over TCP: %w", err)
+	}
+
+	response := DNSMessage{}
+	err = response.Decode(packet)
+	if err != nil {
+		return DNSMessage{}, fmt.Errorf("failure on decoding response from resolver over TCP: %w", err)
+	}
+
+	// same checks as for UDP in deliver
+	if len(response.Questions) != 1 || !response.Header.FLAGS.GetQR() || newPendingKey(response.Header.ID, response.Questions[0]) != key {
+		return DNSMessage{}, fmt.Errorf("response from resolver over TCP with ID %d doesn't match the query", response.Header.ID)
+	}
+
+	return response, nil
+}
+
+// String returns address of the resolver
+func (c *Upstream) String() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Upstream) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+
+	close(c.closed)
+	return c.conn.Close()
+}
+
+// picks random ID that is not used by any other query for the same question
+func (c *Upstream) register(question DNSQuestion) (pendingKey, chan DNSMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return pendingKey{}, nil, ErrUpstreamClosed
+	default:
+	}
+
+	for {
+		key := newPendingKey(uint16(rand.IntN(1<<16)), question)
+		if _, taken := c.pending[key]; taken {
+			continue
+		}
+
+		// buffered so the read loop never blocks on a query that has just given up waiting
+		responses := make(chan DNSMessage, 1)
+		c.pending[key] = responses
+		return key, responses, nil
+	}
+}
+
+func (c *Upstream) unregister(key pendingKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, key)
+}
+
+// hands the response to the query waiting for it - returns false when nobody asked for it
+func (c *Upstream) deliver(response DNSMessage) bool {
+	if len(response.Questions) != 1 || !response.Header.FLAGS.GetQR() {
+		return false
+	}
+
+	key := newPendingKey(response.Header.ID, response.Questions[0])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	responses, ok := c.pending[key]
+	if !ok {
+		return false
+	}
+	// only the first response counts - duplicates are treated as unexpected
+	delete(c.pending, key)
+	responses <- response
+	return true
+}
+
+func (c *Upstream) readLoop() {
+	buf := make([]byte, EDNSUDPPayloadSize)
+
+	for {
+		size, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// connection refused and similar errors are reported on the next read after ICMP arrives
+			// they don't break the socket so we keep reading - waiting queries will time out
+			fmt.Println("error receiving data from resolver:", err)
+			continue
+		}
+
+		response := DNSMessage{}
+		err = response.Decode(buf[:size])
+		if err != nil {
+			fmt.Printf("failure on decoding response from resolver: %v\n", err)
+			continue
+		}
+
+		if !c.deliver(response) {
+			fmt.Printf("dropping response from resolver with ID %d that doesn't match any query\n", response.Header.ID)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUpstreamTestQuery(name string) DNSMessage {
+	return DNSMessage{
+		Header: DNSHeader{ID: 1, QDCOUNT: 1},
+		Questions: []DNSQuestion{
+			{Name: EncodeName(name), Type: TypeA, Class: ClassIN},
+		},
+	}
+}
+
+// resolver answers in random order - every query has to get the answer for its own question
+func TestUpstreamClientConcurrentExchanges(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		time.Sleep(time.Duration(query.Header.ID%20) * time.Millisecond)
+		response := newTestResponse(query)
+		// answer carries the name it was asked for so we can check it reached the right caller
+		answer, _ := NewAnswer(DecodeName(query.Questions[0].Name), ClassIN, 60, &RDataTXT{Texts: []string{DecodeName(query.Questions[0].Name)}})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.mfranc.com", i)
+
+			response, err := upstream.Exchange(context.Background(), newUpstreamTestQuery(name))
+			assert.NoError(t, err)
+			if assert.Equal(t, 1, len(response.Answers)) {
+				rdata, err := response.Answers[0].RData()
+				assert.NoError(t, err)
+				assert.Equal(t, &RDataTXT{Texts: []string{name}}, rdata)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUpstreamClientRandomizesIDs(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[uint16]bool{}
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		mu.Lock()
+		seen[query.Header.ID] = true
+		mu.Unlock()
+		return newTestResponse(query)
+	})
+
+	for range 10 {
+		// caller always uses ID 1
+		_, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+		assert.NoError(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestUpstreamClientRejectsUnexpectedResponses(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		switch DecodeName(query.Questions[0].Name) {
+		case "wrong-id.mfranc.com":
+			response := newTestResponse(query)
+			response.Header.ID++
+			return response
+		case "wrong-question.mfranc.com":
+			response := newTestResponse(query)
+			response.Questions = []DNSQuestion{{Name: EncodeName("evil.com"), Type: TypeA, Class: ClassIN}}
+			return response
+		case "not-a-response.mfranc.com":
+			return &query
+		}
+		return newTestResponse(query)
+	})
+	upstream.Retry = RetryPolicy{Attempts: 1, AttemptTimeout: 100 * time.Millisecond, MaxAttemptTimeout: 100 * time.Millisecond}
+
+	for _, name := range []string{"wrong-id.mfranc.com", "wrong-question.mfranc.com", "not-a-response.mfranc.com"} {
+		_, err := upstream.Exchange(context.Background(), newUpstreamTestQuery(name))
+		assert.ErrorIs(t, err, ErrUpstreamTimeout, name)
+	}
+
+	// nothing is left behind in the in-flight table
+	upstream.mu.Lock()
+	assert.Equal(t, 0, len(upstream.pending))
+	upstream.mu.Unlock()
+
+	_, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("MFRANC.com"))
+	assert.NoError(t, err)
+}
+
+func TestUpstreamClientDeliverMatchesCaseInsensitive(t *testing.T) {
+	client := &Upstream{pending: map[pendingKey]chan DNSMessage{}, closed: make(chan struct{})}
+
+	key, responses, err := client.register(DNSQuestion{Name: EncodeName("MFranc.com"), Type: TypeA, Class: ClassIN})
+	assert.NoError(t, err)
+
+	response := DNSMessage{
+		Header:    DNSHeader{ID: key.id},
+		Questions: []DNSQuestion{{Name: EncodeName("mfranc.COM"), Type: TypeA, Class: ClassIN}},
+	}
+	response.Header.FLAGS.SetQR(true)
+
+	assert.True(t, client.deliver(response))
+	assert.Equal(t, response, <-responses)
+
+	// second response with the same ID is not expected anymore
+	assert.False(t, client.deliver(response))
+}
+
+func TestUpstreamClientExchangeErrors(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage { return nil })
+
+	query := newUpstreamTestQuery("mfranc.com")
+	query.Questions = append(query.Questions, query.Questions[0])
+	_, err := upstream.Exchange(context.Background(), query)
+	assert.Error(t, err)
+
+	// closing wakes up queries that are still waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		upstream.Close()
+	}()
+	_, err = upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.ErrorIs(t, err, ErrUpstreamClosed)
+
+	_, err = upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.ErrorIs(t, err, ErrUpstreamClosed)
+}
+
+func TestUpstreamRetryPolicyTimeout(t *testing.T) {
+	policy := RetryPolicy{Attempts: 5, AttemptTimeout: 100 * time.Millisecond, MaxAttemptTimeout: 350 * time.Millisecond}
+
+	// without jitter it's plain doubling capped at max
+	assert.Equal(t, 100*time.Millisecond, policy.timeout(0))
+	assert.Equal(t, 200*time.Millisecond, policy.timeout(1))
+	assert.Equal(t, 350*time.Millisecond, policy.timeout(2))
+	assert.Equal(t, 350*time.Millisecond, policy.timeout(10))
+
+	policy.Jitter = 0.5
+	for range 100 {
+		timeout := policy.timeout(1)
+		assert.GreaterOrEqual(t, timeout, 200*time.Millisecond)
+		assert.Less(t, timeout, 300*time.Millisecond)
+	}
+}
+
+// resolver "loses" first two queries - third attempt is answered
+func TestUpstreamClientRetransmits(t *testing.T) {
+	var mu sync.Mutex
+	var ids []uint16
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, query.Header.ID)
+		if len(ids) < 3 {
+			return nil
+		}
+		return newTestResponse(query)
+	})
+	upstream.Retry = RetryPolicy{Attempts: 3, AttemptTimeout: 20 * time.Millisecond, MaxAttemptTimeout: time.Second, Jitter: 0.1}
+
+	start := time.Now()
+	_, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.NoError(t, err)
+	// waited 20ms and 40ms before the last attempt
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, len(ids))
+	// retransmission uses the same ID so late answers to earlier attempts still match
+	assert.Equal(t, ids[0], ids[1])
+	assert.Equal(t, ids[0], ids[2])
+}
+
+func TestUpstreamClientGivesUpAfterAttempts(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		sent++
+		return nil
+	})
+	upstream.Retry = RetryPolicy{Attempts: 2, AttemptTimeout: 20 * time.Millisecond, MaxAttemptTimeout: time.Second}
+
+	_, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.ErrorIs(t, err, ErrUpstreamTimeout)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, sent)
+}
+
+func TestUpstreamClientExchangeCancelled(t *testing.T) {
+	upstream := newTestUpstream(t, func(query DNSMessage) *DNSMessage { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := upstream.Exchange(ctx, newUpstreamTestQuery("mfranc.com"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// resolver listening on TCP on the same port as the UDP one - every query is answered with respond
+func startFakeTCPResolver(t *testing.T, addr *net.UDPAddr, respond func(query DNSMessage) *DNSMessage) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				packet, err := ReadTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				query := DNSMessage{}
+				if err := query.Decode(packet); err != nil {
+					return
+				}
+				encoded, err := respond(query).Encode()
+				if err != nil {
+					return
+				}
+				_ = WriteTCPMessage(conn, encoded)
+			}()
+		}
+	}()
+}
+
+func TestUpstreamClientRetriesTruncatedOverTCP(t *testing.T) {
+	addr := startFakeResolver(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		response.Header.FLAGS.SetTC(true)
+		return response
+	})
+	startFakeTCPResolver(t, addr, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		answer, _ := NewAnswer("mfranc.com", ClassIN, 60, &RDataA{IP: net.IPv4(10, 0, 0, 1)})
+		response.Answers = []DNSAnswer{answer}
+		response.Header.ANCOUNT = 1
+		return response
+	})
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	assert.NoError(t, err)
+	upstream := NewUpstream(conn)
+	defer upstream.Close()
+
+	response, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.NoError(t, err)
+	assert.False(t, response.Header.FLAGS.GetTC())
+	assert.Equal(t, 1, len(response.Answers))
+}
+
+func TestUpstreamClientRejectsMismatchedTCPResponse(t *testing.T) {
+	addr := startFakeResolver(t, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		response.Header.FLAGS.SetTC(true)
+		return response
+	})
+	startFakeTCPResolver(t, addr, func(query DNSMessage) *DNSMessage {
+		response := newTestResponse(query)
+		response.Header.ID++
+		return response
+	})
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	assert.NoError(t, err)
+	upstream := NewUpstream(conn)
+	defer upstream.Close()
+
+	// TCP answer is not trusted so the truncated one is returned
+	response, err := upstream.Exchange(context.Background(), newUpstreamTestQuery("mfranc.com"))
+	assert.NoError(t, err)
+	assert.True(t, response.Header.FLAGS.GetTC())
+}
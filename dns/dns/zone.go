@@ -0,0 +1,318 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// CNAME pointing to another CNAME in the zone is followed at most that many times so a loop doesn't hang us
+const maxCNAMEChain = 8
+
+// Zone holds records of a zone we are authoritative for - everything from its apex (the SOA owner)
+// down to the delegations to other servers
+type Zone struct {
+	// lowercase without the trailing dot, empty is the root
+	origin string
+	soa    DNSAnswer
+	// SOA with TTL of negative answers - https://www.rfc-editor.org/rfc/rfc2308#section-3
+	negativeSOA DNSAnswer
+	// lowercase owner => records in the order from the file
+	records map[string][]DNSAnswer
+	// owners of records and all the names between them and the apex (empty non-terminals)
+	// name that's here exists even without records so it gets NODATA and not NXDOMAIN
+	// https://www.rfc-editor.org/rfc/rfc8020
+	names map[string]bool
+}
+
+func newZone(records []DNSAnswer) (*Zone, error) {
+	zone := &Zone{records: map[string][]DNSAnswer{}, names: map[string]bool{}}
+
+	var soas []DNSAnswer
+	for _, record := range records {
+		if record.Type == TypeSOA {
+			soas = append(soas, record)
+		}
+	}
+	if len(soas) != 1 {
+		return nil, fmt.Errorf("zone has to have exactly one SOA got: %d", len(soas))
+	}
+
+	zone.soa = soas[0]
+	zone.origin = strings.ToLower(DecodeName(zone.soa.Name))
+	rdata, err := zone.soa.RData()
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOA: %w", err)
+	}
+	zone.negativeSOA = zone.soa
+	zone.negativeSOA.TTL = min(zone.soa.TTL, rdata.(*RDataSOA).Minimum)
+
+	for _, record := range records {
+		owner := strings.ToLower(DecodeName(record.Name))
+		if !zone.contains(owner) {
+			return nil, fmt.Errorf("record %s is outside of zone %s", owner, zone.origin)
+		}
+		zone.records[owner] = append(zone.records[owner], record)
+
+		for name := owner; !zone.names[name]; name = parentName(name) {
+			zone.names[name] = true
+			if name == zone.origin {
+				break
+			}
+		}
+	}
+
+	// alias can't have any other data - https://www.rfc-editor.org/rfc/rfc2181#section-10.1
+	for owner, records := range zone.records {
+		if len(rrset(records, TypeCNAME)) > 0 && len(records) > 1 {
+			return nil, fmt.Errorf("%s has CNAME and other records", owner)
+		}
+	}
+
+	return zone, nil
+}
+
+// Origin returns the apex of the zone without the trailing dot
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// name has to be lowercase
+func (z *Zone) contains(name string) bool {
+	// whole labels have to match - a\.example.com ends with .example.com but it's the label a.example under com
+	for ; name != ""; name = parentName(name) {
+		if name == z.origin {
+			return true
+		}
+	}
+	return z.origin == ""
+}
+
+// sections and rcode of the answer for one question
+type zoneAnswer struct {
+	answers    []DNSAnswer
+	authority  []DNSAnswer
+	additional []DNSAnswer
+	rcode      uint16
+	// false for referrals - the answer is up to the server the name is delegated to
+	authoritative bool
+}
+
+// answers the question for the name in the zone - https://www.rfc-editor.org/rfc/rfc1034#section-4.3.2
+//   - records of the asked type (or all of them for ANY)
+//   - CNAME followed while its target is in the zone
+//   - referral to the delegated servers when the name is at or below a zone cut
+//   - NODATA (no records of the asked type) and NXDOMAIN (no such name) with SOA in authority
+//   - records of the wildcard matching the name that doesn't exist, with the name changed to the asked one
+func (z *Zone) answer(question DNSQuestion) zoneAnswer {
+	owner := question.Name
+	name := strings.ToLower(DecodeName(owner))
+	if !z.contains(name) {
+		// not ours to answer - ZoneHandler sends such names to its Fallback
+		return zoneAnswer{rcode: RcodeRefused}
+	}
+
+	result := zoneAnswer{authoritative: true}
+
+	for range maxCNAMEChain {
+		if cut, ok := z.delegation(name); ok {
+			// alias pointing below a zone cut - client follows it on its own
+			if len(result.answers) > 0 {
+				return result
+			}
+			return z.referral(cut)
+		}
+
+		records := z.records[name]
+		if !z.names[name] {
+			wildcard, ok := z.wildcard(name)
+			if !ok {
+				result.rcode = RcodeNameError
+				result.authority = []DNSAnswer{z.negativeSOA}
+				return result
+			}
+			// answers are synthesized from the wildcard with the asked name as owner
+			records = z.records[wildcard]
+		}
+
+		if matched := rrset(records, question.Type); len(matched) > 0 {
+			result.answers = append(result.answers, withOwner(matched, owner)...)
+			return result
+		}
+
+		cname := rrset(records, TypeCNAME)
+		if len(cname) == 0 {
+			result.authority = []DNSAnswer{z.negativeSOA}
+			return result
+		}
+		result.answers = append(result.answers, withOwner(cname, owner)...)
+
+		rdata, err := cname[0].RData()
+		if err != nil {
+			return result
+		}
+		target := rdata.(*RDataCNAME).Target
+		name = strings.ToLower(target)
+		if !z.contains(name) {
+			return result
+		}
+		owner = EncodeName(target)
+	}
+	return result
+}
+
+// wildcard that can answer for the name that doesn't exist - https://www.rfc-editor.org/rfc/rfc4592#section-3.3.1
+// only the one right below the closest encloser (the longest existing ancestor of the name) counts
+// so *.example.com doesn't answer for a.b.example.com when b.example.com exists - even without records
+func (z *Zone) wildcard(name string) (string, bool) {
+	encloser := parentName(name)
+	// stops at the root as well so name outside the zone can't loop forever
+	for !z.names[encloser] && encloser != z.origin && encloser != "" {
+		encloser = parentName(encloser)
+	}
+
+	source := "*"
+	if encloser != "" {
+		source += "." + encloser
+	}
+	return source, z.names[source]
+}
+
+// the topmost name between the apex and the name (inclusive) that has NS records - the zone cut
+// NS records at the apex are ours so they don't count
+func (z *Zone) delegation(name string) (string, bool) {
+	var cut string
+	found := false
+	for ; name != z.origin && z.contains(name); name = parentName(name) {
+		if len(rrset(z.records[name], TypeNS)) > 0 {
+			cut = name
+			found = true
+		}
+	}
+	return cut, found
+}
+
+// NS records of the zone cut with addresses of the servers that are in our zone (glue)
+func (z *Zone) referral(cut string) zoneAnswer {
+	result := zoneAnswer{authority: rrset(z.records[cut], TypeNS)}
+	for _, ns := range result.authority {
+		rdata, err := ns.RData()
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(rdata.(*RDataNS).Host)
+		result.additional = append(result.additional, rrset(z.records[host], TypeA)...)
+		result.additional = append(result.additional, rrset(z.records[host], TypeAAAA)...)
+	}
+	return result
+}
+
+func rrset(records []DNSAnswer, rrType uint16) []DNSAnswer {
+	var matched []DNSAnswer
+	for _, record := range records {
+		if record.Type == rrType || rrType == TypeANY {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+// answers carry the name the way client asked for it
+func withOwner(records []DNSAnswer, owner []byte) []DNSAnswer {
+	var renamed []DNSAnswer
+	for _, record := range records {
+		record.Name = owner
+		renamed = append(renamed, record)
+	}
+	return renamed
+}
+
+// www.example.com => example.com, com => root (empty)
+// escaped dot is inside the label - john\.doe.example.com => example.com
+func parentName(name string) string {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return name[i+1:]
+		}
+	}
+	return ""
+}
+
+// ZoneHandler answers authoritatively (with AA bit) for names in its zones
+// queries for other names go to Fallback - or are REFUSED when it's not set
+// query with many questions is answered from the zones only when all of them are in the zones
+type ZoneHandler struct {
+	// lowercase origin => zone
+	zones map[string]*Zone
+	// can be changed only before the first query
+	Fallback Handler
+}
+
+// NewZoneHandler serves the zones - every zone has to have different origin
+func NewZoneHandler(zones ...*Zone) (*ZoneHandler, error) {
+	handler := &ZoneHandler{zones: map[string]*Zone{}}
+	for _, zone := range zones {
+		if _, ok := handler.zones[zone.origin]; ok {
+			return nil, fmt.Errorf("zone %s is loaded twice", zone.origin)
+		}
+		handler.zones[zone.origin] = zone
+	}
+	return handler, nil
+}
+
+func (h *ZoneHandler) ServeDNS(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+	zones := make([]*Zone, 0, len(req.Questions))
+	for _, question := range req.Questions {
+		zone := h.zoneFor(question.Name)
+		if zone == nil {
+			h.serveOutOfZone(ctx, w, req)
+			return
+		}
+		zones = append(zones, zone)
+	}
+
+	response := NewResponse(req)
+	authoritative := true
+	for i, question := range req.Questions {
+		result := zones[i].answer(question)
+		response.Answers = append(response.Answers, result.answers...)
+		response.Authority = append(response.Authority, result.authority...)
+		response.Additional = append(response.Additional, result.additional...)
+		authoritative = authoritative && result.authoritative
+
+		// first failure wins the same way as with the resolver
+		if response.Header.FLAGS.GetRcode() == RcodeSuccess {
+			_ = response.Header.FLAGS.SetRcode(result.rcode)
+		}
+	}
+	response.Header.FLAGS.SetAA(authoritative)
+	writeResponse(w, response)
+}
+
+func (h *ZoneHandler) serveOutOfZone(ctx context.Context, w ResponseWriter, req *DNSMessage) {
+	if h.Fallback != nil {
+		h.Fallback.ServeDNS(ctx, w, req)
+		return
+	}
+
+	response := NewResponse(req)
+	_ = response.Header.FLAGS.SetRcode(RcodeRefused)
+	writeResponse(w, response)
+}
+
+// zone with the longest origin the name is in
+func (h *ZoneHandler) zoneFor(name []byte) *Zone {
+	lower := strings.ToLower(DecodeName(name))
+	for {
+		if zone, ok := h.zones[lower]; ok {
+			return zone
+		}
+		if lower == "" {
+			return nil
+		}
+		lower = parentName(lower)
+	}
+}
@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestZoneQuestion(name string, rrType uint16) DNSQuestion {
+	return DNSQuestion{Name: EncodeName(name), Type: rrType, Class: ClassIN}
+}
+
+// names and types of the records - enough to tell which ones they are
+func testRecordNames(records []DNSAnswer) []string {
+	var names []string
+	for _, record := range records {
+		names = append(names, DecodeName(record.Name)+" "+typeName(record.Type))
+	}
+	return names
+}
+
+func typeName(rrType uint16) string {
+	names := map[uint16]string{TypeA: "A", TypeAAAA: "AAAA", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypeMX: "MX", TypeTXT: "TXT"}
+	return names[rrType]
+}
+
+func TestZoneAnswer(t *testing.T) {
+	zone := parseTestZone(t)
+
+	tests := []struct {
+		name          string
+		question      DNSQuestion
+		rcode         uint16
+		answers       []string
+		authority     []string
+		additional    []string
+		authoritative bool
+	}{
+		{
+			name:          "answer keeps the case of the question",
+			question:      newTestZoneQuestion("WWW.Example.com", TypeA),
+			answers:       []string{"WWW.Example.com A"},
+			authoritative: true,
+		},
+		{
+			name:          "any",
+			question:      newTestZoneQuestion("www.example.com", TypeANY),
+			answers:       []string{"www.example.com A", "www.example.com AAAA"},
+			authoritative: true,
+		},
+		{
+			name:          "apex",
+			question:      newTestZoneQuestion("example.com", TypeNS),
+			answers:       []string{"example.com NS", "example.com NS"},
+			authoritative: true,
+		},
+		{
+			name:          "NODATA",
+			question:      newTestZoneQuestion("www.example.com", TypeMX),
+			authority:     []string{"example.com SOA"},
+			authoritative: true,
+		},
+		{
+			name:          "empty non-terminal is NODATA",
+			question:      newTestZoneQuestion("deep.example.com", TypeA),
+			authority:     []string{"example.com SOA"},
+			authoritative: true,
+		},
+		{
+			name:          "NXDOMAIN",
+			question:      newTestZoneQuestion("nope.example.com", TypeA),
+			rcode:         RcodeNameError,
+			authority:     []string{"example.com SOA"},
+			authoritative: true,
+		},
+		{
+			name:          "CNAME is followed",
+			question:      newTestZoneQuestion("alias.example.com", TypeA),
+			answers:       []string{"alias.example.com CNAME", "www.example.com A"},
+			authoritative: true,
+		},
+		{
+			name:          "CNAME asked for",
+			question:      newTestZoneQuestion("alias.example.com", TypeCNAME),
+			answers:       []string{"alias.example.com CNAME"},
+			authoritative: true,
+		},
+		{
+			name:       "referral",
+			question:   newTestZoneQuestion("www.sub.example.com", TypeA),
+			authority:  []string{"sub.example.com NS"},
+			additional: []string{"ns.sub.example.com A"},
+		},
+		{
+			name:       "referral at the zone cut",
+			question:   newTestZoneQuestion("sub.example.com", TypeNS),
+			authority:  []string{"sub.example.com NS"},
+			additional: []string{"ns.sub.example.com A"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := zone.answer(test.question)
+			assert.Equal(t, test.rcode, result.rcode)
+			assert.Equal(t, test.answers, testRecordNames(result.answers))
+			assert.Equal(t, test.authority, testRecordNames(result.authority))
+			assert.Equal(t, test.additional, testRecordNames(result.additional))
+			assert.Equal(t, test.authoritative, result.authoritative)
+		})
+	}
+
+	// negative answers are cached for SOA MINIMUM
+	result := zone.answer(newTestZoneQuestion("nope.example.com", TypeA))
+	assert.Equal(t, uint32(300), result.authority[0].TTL)
+}
+
+func TestZoneAnswerCNAMEChain(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(`
+@       60 SOA   ns hostmaster 1 2 3 4 5
+loop1   60 CNAME loop2
+loop2   60 CNAME loop1
+away    60 CNAME www.example.net.
+gone    60 CNAME nothing
+`), "example.com.")
+	assert.NoError(t, err)
+
+	result := zone.answer(newTestZoneQuestion("loop1.example.com", TypeA))
+	assert.Len(t, result.answers, maxCNAMEChain)
+
+	// the client follows the alias out of our zone on its own
+	result = zone.answer(newTestZoneQuestion("away.example.com", TypeA))
+	assert.Equal(t, []string{"away.example.com CNAME"}, testRecordNames(result.answers))
+	assert.Equal(t, RcodeSuccess, result.rcode)
+
+	// rcode is about the last name in the chain - https://www.rfc-editor.org/rfc/rfc6604
+	result = zone.answer(newTestZoneQuestion("gone.example.com", TypeA))
+	assert.Equal(t, []string{"gone.example.com CNAME"}, testRecordNames(result.answers))
+	assert.Equal(t, RcodeNameError, result.rcode)
+}
+
+func TestZoneHandler(t *testing.T) {
+	handler, err := NewZoneHandler(parseTestZone(t))
+	assert.NoError(t, err)
+
+	query := newTestQuery(t, nil)
+	query.Questions[0].Name = EncodeName("www.example.com")
+	decoded := decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.True(t, decoded.Header.FLAGS.GetAA())
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, []string{"www.example.com A"}, testRecordNames(decoded.Answers))
+
+	query.Questions[0].Name = EncodeName("nope.example.com")
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.True(t, decoded.Header.FLAGS.GetAA())
+	assert.Equal(t, RcodeNameError, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, []string{"example.com SOA"}, testRecordNames(decoded.Authority))
+
+	query.Questions[0].Name = EncodeName("www.sub.example.com")
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.False(t, decoded.Header.FLAGS.GetAA())
+	assert.Equal(t, []string{"sub.example.com NS"}, testRecordNames(decoded.Authority))
+
+	// we are not authoritative for it and there is nobody else to ask
+	query.Questions[0].Name = EncodeName("mfranc.com")
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeRefused, decoded.Header.FLAGS.GetRcode())
+	assert.False(t, decoded.Header.FLAGS.GetAA())
+
+	handler.Fallback = LocalHandler{}
+	decoded = decodeTestResponse(t, handlePacket(context.Background(), handler, encodeTestQuery(t, query), transportUDP, nil))
+	assert.Equal(t, RcodeSuccess, decoded.Header.FLAGS.GetRcode())
+	assert.Equal(t, []string{"mfranc.com A"}, testRecordNames(decoded.Answers))
+}
+
+func TestZoneHandlerLongestOrigin(t *testing.T) {
+	parent := parseTestZone(t)
+	child, err := ParseZone(strings.NewReader("@ 60 SOA ns hostmaster 1 2 3 4 5\nwww 60 A 192.0.2.1\n"), "sub.example.com.")
+	assert.NoError(t, err)
+
+	handler, err := NewZoneHandler(parent, child)
+	assert.NoError(t, err)
+	assert.Equal(t, child, handler.zoneFor(EncodeName("www.sub.example.com")))
+	assert.Equal(t, child, handler.zoneFor(EncodeName("SUB.example.com")))
+	assert.Equal(t, parent, handler.zoneFor(EncodeName("www.example.com")))
+	assert.Nil(t, handler.zoneFor(EncodeName("example.net")))
+
+	_, err = NewZoneHandler(parent, parseTestZone(t))
+	assert.EqualError(t, err, "zone example.com is loaded twice")
+}
+
+func TestZoneAnswerWildcard(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(`
+$TTL 60
+@           SOA   ns hostmaster 1 2 3 4 5
+www         A     192.0.2.1
+*.apps      A     192.0.2.10
+*.apps      TXT   "wild"
+db.apps     A     192.0.2.11
+x.y.apps    A     192.0.2.12
+*.preview   CNAME www
+`), "example.com.")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		question  DNSQuestion
+		rcode     uint16
+		answers   []string
+		authority []string
+	}{
+		{
+			name:     "owner is synthesized",
+			question: newTestZoneQuestion("web.apps.example.com", TypeA),
+			answers:  []string{"web.apps.example.com A"},
+		},
+		{
+			name:     "wildcard matches many labels",
+			question: newTestZoneQuestion("a.b.apps.example.com", TypeA),
+			answers:  []string{"a.b.apps.example.com A"},
+		},
+		{
+			name:      "NODATA from wildcard",
+			question:  newTestZoneQuestion("web.apps.example.com", TypeMX),
+			authority: []string{"example.com SOA"},
+		},
+		{
+			name:     "existing name is not replaced by wildcard",
+			question: newTestZoneQuestion("db.apps.example.com", TypeA),
+			answers:  []string{"db.apps.example.com A"},
+		},
+		{
+			name:      "existing name blocks wildcard for other types",
+			question:  newTestZoneQuestion("db.apps.example.com", TypeTXT),
+			authority: []string{"example.com SOA"},
+		},
+		{
+			name:      "empty non-terminal blocks wildcard",
+			question:  newTestZoneQuestion("y.apps.example.com", TypeA),
+			authority: []string{"example.com SOA"},
+		},
+		{
+			name:      "closest encloser without wildcard",
+			question:  newTestZoneQuestion("z.y.apps.example.com", TypeA),
+			rcode:     RcodeNameError,
+			authority: []string{"example.com SOA"},
+		},
+		{
+			name:     "wildcard asked for directly",
+			question: newTestZoneQuestion("*.apps.example.com", TypeA),
+			answers:  []string{"*.apps.example.com A"},
+		},
+		{
+			name:     "CNAME from wildcard is followed",
+			question: newTestZoneQuestion("pr-1.preview.example.com", TypeA),
+			answers:  []string{"pr-1.preview.example.com CNAME", "www.example.com A"},
+		},
+		{
+			name:      "no wildcard at the apex",
+			question:  newTestZoneQuestion("nope.example.com", TypeA),
+			rcode:     RcodeNameError,
+			authority: []string{"example.com SOA"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := zone.answer(test.question)
+			assert.Equal(t, test.rcode, result.rcode)
+			assert.Equal(t, test.answers, testRecordNames(result.answers))
+			assert.Equal(t, test.authority, testRecordNames(result.authority))
+			assert.True(t, result.authoritative)
+		})
+	}
+}
+
+func TestZoneAnswerWildcardAtApex(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader("@ 60 SOA ns hostmaster 1 2 3 4 5\n* 60 A 192.0.2.1\nsub 60 NS ns.other.\n"), "preview.")
+	assert.NoError(t, err)
+
+	result := zone.answer(newTestZoneQuestion("Branch-42.preview", TypeA))
+	assert.Equal(t, []string{"Branch-42.preview A"}, testRecordNames(result.answers))
+
+	// delegation wins over the wildcard
+	result = zone.answer(newTestZoneQuestion("www.sub.preview", TypeA))
+	assert.False(t, result.authoritative)
+	assert.Equal(t, []string{"sub.preview NS"}, testRecordNames(result.authority))
+}
+
+// names outside the zone end at the root without passing the apex
+func TestZoneAnswerOutOfZone(t *testing.T) {
+	zone := parseTestZone(t)
+
+	result := zone.answer(newTestZoneQuestion("www.example.net", TypeA))
+	assert.Equal(t, RcodeRefused, result.rcode)
+	assert.False(t, result.authoritative)
+	assert.Empty(t, result.answers)
+
+	_, ok := zone.wildcard("www.example.net")
+	assert.False(t, ok)
+}
@@ -0,0 +1,459 @@
+package dns
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// master file syntax - https://www.rfc-editor.org/rfc/rfc1035#section-5
+// one record per line, parentheses let a record span many lines (SOA usually does) and `;` starts a comment
+//
+//	$ORIGIN example.com.
+//	$TTL 1h
+//	@       IN SOA ns1 hostmaster (
+//	                2024010101 ; serial
+//	                1h 15m 1w 5m )
+//	        IN NS  ns1
+//	ns1     IN A   192.0.2.1
+//	www  5m IN A   192.0.2.2
+//
+// names without the trailing dot are relative to $ORIGIN, `@` is $ORIGIN itself
+// line starting with a space has the same owner as the record before it
+// TTL and class can be left out - TTL comes from $TTL (https://www.rfc-editor.org/rfc/rfc2308#section-4)
+// or the last record with explicit TTL, class is always IN
+type zoneToken struct {
+	text string
+	// quoted strings keep spaces and can be empty - TXT needs that
+	quoted bool
+}
+
+// text of the token with escapes of the bare token resolved - for values that are not names
+// quoted strings are unescaped when read
+func (t zoneToken) value() string {
+	if t.quoted {
+		return t.text
+	}
+	// splitName resolves the escapes and the dots that are left are plain text again
+	return strings.Join(splitName(t.text), ".")
+}
+
+// record or directive - can span many lines in the file when it has parentheses
+type zoneLine struct {
+	tokens []zoneToken
+	// line started with a space so the owner is the one from the record before
+	blankOwner bool
+	// line in the file where it starts - for errors
+	number int
+}
+
+// LoadZoneFile reads zone from master file - see ParseZone
+func LoadZoneFile(path string) (*Zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone file: %w", err)
+	}
+	defer file.Close()
+
+	zone, err := ParseZone(file, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return zone, nil
+}
+
+// ParseZone reads zone in master file syntax
+// origin is used for relative names until the file sets its own with $ORIGIN, it can be empty when it does
+// zone has to have exactly one SOA - its owner is the apex and every other record has to be at or below it
+func ParseZone(r io.Reader, origin string) (*Zone, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone: %w", err)
+	}
+
+	lines, err := splitZoneLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	parser := zoneParser{origin: strings.TrimSuffix(origin, ".")}
+	for _, line := range lines {
+		err = parser.parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.number, err)
+		}
+	}
+
+	return newZone(parser.records)
+}
+
+// splits the file into tokens grouped by records - comments are dropped and parentheses joined
+func splitZoneLines(data string) ([]zoneLine, error) {
+	var lines []zoneLine
+	var current zoneLine
+	number := 1
+	parens := 0
+
+	for i := 0; i < len(data); {
+		if len(current.tokens) == 0 && parens == 0 && (i == 0 || data[i-1] == '\n') {
+			current.blankOwner = data[i] == ' ' || data[i] == '\t'
+			current.number = number
+		}
+
+		switch c := data[i]; c {
+		case '\n':
+			number++
+			i++
+			if parens == 0 {
+				if len(current.tokens) > 0 {
+					lines = append(lines, current)
+				}
+				current = zoneLine{}
+			}
+		case ' ', '\t', '\r':
+			i++
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case '(':
+			parens++
+			i++
+		case ')':
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unexpected )", number)
+			}
+			parens--
+			i++
+		case '"':
+			text, end, err := readQuoted(data, i+1)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", number, err)
+			}
+			current.tokens = append(current.tokens, zoneToken{text: text, quoted: true})
+			i = end
+		default:
+			// escapes are kept - in names \. is a dot inside the label, not between labels
+			// so the token is unescaped only where it's used as text (see zoneToken.value)
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n;()\"", rune(data[i])) {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				i++
+			}
+			current.tokens = append(current.tokens, zoneToken{text: data[start:i]})
+		}
+	}
+
+	if parens > 0 {
+		return nil, fmt.Errorf("line %d: missing )", current.number)
+	}
+	if len(current.tokens) > 0 {
+		lines = append(lines, current)
+	}
+	return lines, nil
+}
+
+// reads quoted string starting right after the opening quote - returns its text and offset after the closing quote
+// \" and \\ are taken as they are and \DDD is a byte given in decimal
+func readQuoted(data string, start int) (string, int, error) {
+	var text strings.Builder
+	for i := start; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			return text.String(), i + 1, nil
+		case '\n':
+			return "", 0, fmt.Errorf("quoted string not closed before end of line")
+		case '\\':
+			if i+3 < len(data) && isDigits(data[i+1:i+4]) {
+				value, _ := strconv.Atoi(data[i+1 : i+4])
+				if value > 255 {
+					return "", 0, fmt.Errorf("invalid escape \\%s", data[i+1:i+4])
+				}
+				text.WriteByte(byte(value))
+				i += 3
+			} else if i+1 < len(data) {
+				text.WriteByte(data[i+1])
+				i++
+			}
+		default:
+			text.WriteByte(data[i])
+		}
+	}
+	return "", 0, fmt.Errorf("quoted string not closed")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+type zoneParser struct {
+	// without the trailing dot, empty is the root
+	origin     string
+	defaultTTL *uint32
+	lastTTL    *uint32
+	lastOwner  string
+	hasOwner   bool
+	records    []DNSAnswer
+}
+
+func (p *zoneParser) parseLine(line zoneLine) error {
+	tokens := line.tokens
+	if directive := strings.ToUpper(tokens[0].text); !tokens[0].quoted && strings.HasPrefix(directive, "$") {
+		return p.parseDirective(directive, tokens[1:])
+	}
+
+	if line.blankOwner && !p.hasOwner {
+		return fmt.Errorf("record without owner")
+	}
+	owner := p.lastOwner
+	if !line.blankOwner {
+		var err error
+		owner, err = p.absoluteName(tokens[0].text)
+		if err != nil {
+			return err
+		}
+		tokens = tokens[1:]
+	}
+	p.lastOwner = owner
+	p.hasOwner = true
+
+	// TTL and class can come in any order before the type
+	var ttl *uint32
+	for range 2 {
+		if len(tokens) == 0 {
+			break
+		}
+		if strings.EqualFold(tokens[0].text, "IN") {
+			tokens = tokens[1:]
+			continue
+		}
+		if value, err := parseZoneTTL(tokens[0].text); err == nil && ttl == nil {
+			ttl = &value
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("record without type")
+	}
+
+	if ttl == nil {
+		ttl = cmp.Or(p.defaultTTL, p.lastTTL)
+		if ttl == nil {
+			return fmt.Errorf("record without TTL and no $TTL before it")
+		}
+	} else {
+		p.lastTTL = ttl
+	}
+
+	rdata, err := p.parseRData(strings.ToUpper(tokens[0].text), tokens[1:])
+	if err != nil {
+		return err
+	}
+
+	record, err := NewAnswer(owner, ClassIN, *ttl, rdata)
+	if err != nil {
+		return err
+	}
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *zoneParser) parseDirective(directive string, args []zoneToken) error {
+	switch directive {
+	case "$ORIGIN":
+		if len(args) != 1 || !isAbsoluteName(args[0].text) {
+			return fmt.Errorf("$ORIGIN needs one absolute name")
+		}
+		origin, err := p.absoluteName(args[0].text)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		if len(args) != 1 {
+			return fmt.Errorf("$TTL needs one value")
+		}
+		ttl, err := parseZoneTTL(args[0].text)
+		if err != nil {
+			return err
+		}
+		p.defaultTTL = &ttl
+	default:
+		// $INCLUDE would need to know where the file is, $GENERATE is not a standard
+		return fmt.Errorf("%s is not supported", directive)
+	}
+	return nil
+}
+
+func (p *zoneParser) parseRData(rrType string, args []zoneToken) (RData, error) {
+	want := map[string]int{"A": 1, "AAAA": 1, "NS": 1, "CNAME": 1, "PTR": 1, "MX": 2, "SOA": 7, "SRV": 4, "CAA": 3}
+	if n, ok := want[rrType]; ok && len(args) != n {
+		return nil, fmt.Errorf("%s needs %d values got: %d", rrType, n, len(args))
+	}
+
+	// errors of all the numbers and names are checked once at the end
+	var err error
+	number := func(token zoneToken, bits int) uint64 {
+		value, parseErr := strconv.ParseUint(token.text, 10, bits)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid %s value %q", rrType, token.text)
+		}
+		return value
+	}
+	name := func(token zoneToken) string {
+		absolute, nameErr := p.absoluteName(token.text)
+		if nameErr != nil && err == nil {
+			err = nameErr
+		}
+		return absolute
+	}
+	ttl := func(token zoneToken) uint32 {
+		value, ttlErr := parseZoneTTL(token.text)
+		if ttlErr != nil && err == nil {
+			err = ttlErr
+		}
+		return value
+	}
+
+	var rdata RData
+	switch rrType {
+	case "A":
+		ip := net.ParseIP(args[0].text).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", args[0].text)
+		}
+		rdata = &RDataA{IP: ip}
+	case "AAAA":
+		ip := net.ParseIP(args[0].text)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", args[0].text)
+		}
+		rdata = &RDataAAAA{IP: ip}
+	case "NS":
+		rdata = &RDataNS{Host: name(args[0])}
+	case "CNAME":
+		rdata = &RDataCNAME{Target: name(args[0])}
+	case "PTR":
+		rdata = &RDataPTR{Target: name(args[0])}
+	case "MX":
+		rdata = &RDataMX{Preference: uint16(number(args[0], 16)), Exchange: name(args[1])}
+	case "TXT":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("TXT needs at least one string")
+		}
+		txt := &RDataTXT{}
+		for _, arg := range args {
+			txt.Texts = append(txt.Texts, arg.value())
+		}
+		rdata = txt
+	case "SOA":
+		rdata = &RDataSOA{
+			MName:   name(args[0]),
+			RName:   name(args[1]),
+			Serial:  uint32(number(args[2], 32)),
+			Refresh: ttl(args[3]),
+			Retry:   ttl(args[4]),
+			Expire:  ttl(args[5]),
+			Minimum: ttl(args[6]),
+		}
+	case "SRV":
+		rdata = &RDataSRV{
+			Priority: uint16(number(args[0], 16)),
+			Weight:   uint16(number(args[1], 16)),
+			Port:     uint16(number(args[2], 16)),
+			Target:   name(args[3]),
+		}
+	case "CAA":
+		rdata = &RDataCAA{Flags: uint8(number(args[0], 8)), Tag: args[1].value(), Value: args[2].value()}
+	default:
+		return nil, fmt.Errorf("record type %q is not supported", rrType)
+	}
+	return rdata, err
+}
+
+// name as the rdata types want it - absolute without the trailing dot, root is empty
+func (p *zoneParser) absoluteName(name string) (string, error) {
+	var absolute string
+	switch {
+	case name == ".":
+		absolute = ""
+	case isAbsoluteName(name):
+		absolute = strings.TrimSuffix(name, ".")
+	case p.origin == "":
+		// @ too - zone quietly becoming the root would answer for every name
+		return "", fmt.Errorf("relative name %q without $ORIGIN", name)
+	case name == "@":
+		absolute = p.origin
+	default:
+		absolute = name + "." + p.origin
+	}
+
+	if absolute == "" {
+		return "", nil
+	}
+	for _, label := range splitName(absolute) {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("invalid name %q: labels have to be 1 to 63 characters long", name)
+		}
+	}
+	if len(EncodeName(absolute)) > 255 {
+		return "", fmt.Errorf("name %q is too long", name)
+	}
+	return absolute, nil
+}
+
+// name ends with the dot that is not escaped - foo\. is relative name with the dot inside the label
+func isAbsoluteName(name string) bool {
+	labels := splitName(name)
+	return len(labels) > 1 && labels[len(labels)-1] == ""
+}
+
+// seconds or BIND style units - 1w2d3h4m5s
+func parseZoneTTL(text string) (uint32, error) {
+	if isDigits(text) {
+		value, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TTL %q", text)
+		}
+		return uint32(value), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 60 * 60, 'd': 24 * 60 * 60, 'w': 7 * 24 * 60 * 60}
+	var total, current uint64
+	digits := 0
+	for i := range len(text) {
+		c := text[i]
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			digits++
+			continue
+		}
+
+		unit, ok := units[c|0x20]
+		if !ok || digits == 0 {
+			return 0, fmt.Errorf("invalid TTL %q", text)
+		}
+		total += current * unit
+		current, digits = 0, 0
+		if total > 0xFFFFFFFF {
+			return 0, fmt.Errorf("TTL %q is too big", text)
+		}
+	}
+	if digits > 0 || total == 0 && len(text) == 0 {
+		return 0, fmt.Errorf("invalid TTL %q", text)
+	}
+	return uint32(total), nil
+}
@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testZone = `
+$ORIGIN example.com.
+$TTL 1h
+; multi-line SOA with comments inside
+@       IN  SOA ns1 hostmaster.example.com. (
+                2024010101 ; serial
+                2h         ; refresh
+                15m        ; retry
+                1w         ; expire
+                300 )      ; minimum
+        IN  NS  ns1
+        IN  NS  ns2.example.net.
+        IN  MX  10 mail
+ns1         A   192.0.2.1
+www     60  IN  A     192.0.2.2
+            IN  AAAA  2001:db8::2
+mail    IN  30  A     192.0.2.3
+alias       CNAME www
+txt         TXT "hello world" "with \"quotes\"" plain
+_sip._tcp   SRV 10 5 5060 sip
+a.b.deep    A   192.0.2.4
+caa         CAA 0 issue "letsencrypt.org"
+sub         NS  ns.sub
+ns.sub      A   192.0.2.5
+$ORIGIN other.example.com.
+host        A   192.0.2.6
+`
+
+func parseTestZone(t *testing.T) *Zone {
+	zone, err := ParseZone(strings.NewReader(testZone), "")
+	assert.NoError(t, err)
+	return zone
+}
+
+// records of the owner and type as typed rdata
+func testZoneRData(t *testing.T, zone *Zone, owner string, rrType uint16) []RData {
+	var rdatas []RData
+	for _, record := range rrset(zone.records[owner], rrType) {
+		rdata, err := record.RData()
+		assert.NoError(t, err)
+		rdatas = append(rdatas, rdata)
+	}
+	return rdatas
+}
+
+func TestParseZone(t *testing.T) {
+	zone := parseTestZone(t)
+	assert.Equal(t, "example.com", zone.Origin())
+
+	soa := testZoneRData(t, zone, "example.com", TypeSOA)
+	assert.Equal(t, []RData{&RDataSOA{
+		MName:   "ns1.example.com",
+		RName:   "hostmaster.example.com",
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   900,
+		Expire:  604800,
+		Minimum: 300,
+	}}, soa)
+	assert.Equal(t, uint32(3600), zone.soa.TTL)
+	assert.Equal(t, uint32(300), zone.negativeSOA.TTL)
+
+	assert.Equal(t, []RData{&RDataNS{Host: "ns1.example.com"}, &RDataNS{Host: "ns2.example.net"}},
+		testZoneRData(t, zone, "example.com", TypeNS))
+	assert.Equal(t, []RData{&RDataMX{Preference: 10, Exchange: "mail.example.com"}},
+		testZoneRData(t, zone, "example.com", TypeMX))
+	assert.Equal(t, []RData{&RDataCNAME{Target: "www.example.com"}},
+		testZoneRData(t, zone, "alias.example.com", TypeCNAME))
+	assert.Equal(t, []RData{&RDataTXT{Texts: []string{"hello world", `with "quotes"`, "plain"}}},
+		testZoneRData(t, zone, "txt.example.com", TypeTXT))
+	assert.Equal(t, []RData{&RDataSRV{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}},
+		testZoneRData(t, zone, "_sip._tcp.example.com", TypeSRV))
+	assert.Equal(t, []RData{&RDataCAA{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}},
+		testZoneRData(t, zone, "caa.example.com", TypeCAA))
+	assert.Equal(t, []RData{&RDataA{IP: net.IPv4(192, 0, 2, 6).To4()}},
+		testZoneRData(t, zone, "host.other.example.com", TypeA))
+
+	// explicit TTL in both orders with class, blank owner takes the one before
+	www := zone.records["www.example.com"]
+	assert.Len(t, www, 2)
+	assert.Equal(t, uint32(60), www[0].TTL)
+	assert.Equal(t, TypeAAAA, www[1].Type)
+	assert.Equal(t, uint32(3600), www[1].TTL)
+	assert.Equal(t, uint32(30), zone.records["mail.example.com"][0].TTL)
+
+	// names between records and apex exist without records
+	assert.True(t, zone.names["b.deep.example.com"])
+	assert.True(t, zone.names["deep.example.com"])
+	assert.False(t, zone.names["nope.example.com"])
+}
+
+func TestParseZoneOriginArgument(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader("@ 60 SOA ns hostmaster 1 2 3 4 5\nwww 60 A 192.0.2.1\n"), "example.org.")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.org", zone.Origin())
+	assert.Len(t, zone.records["www.example.org"], 1)
+}
+
+func TestParseZoneLastTTL(t *testing.T) {
+	// without $TTL the last explicit TTL is used
+	zone, err := ParseZone(strings.NewReader("example.org. 60 SOA ns.example.org. h.example.org. 1 2 3 4 5\nwww.example.org. A 192.0.2.1\n"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(60), zone.records["www.example.org"][0].TTL)
+}
+
+func TestParseZoneEscapedDots(t *testing.T) {
+	// \. is the dot inside the label - mailbox john.doe@example.org in SOA RNAME
+	zone, err := ParseZone(strings.NewReader(`@ 60 SOA ns john\.doe 1 2 3 4 5
+dotted\.host 60 A 192.0.2.1
+txt 60 TXT semi\;colon a\.b
+`), "example.org.")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []byte("\x08john.doe\x07example\x03org\x00"), zone.soa.Data[len(EncodeName("ns.example.org")):][:22])
+	assert.Equal(t, []RData{&RDataSOA{MName: "ns.example.org", RName: `john\.doe.example.org`, Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5}},
+		testZoneRData(t, zone, "example.org", TypeSOA))
+
+	records := zone.records[`dotted\.host.example.org`]
+	assert.Len(t, records, 1)
+	assert.Equal(t, []byte("\x0bdotted.host\x07example\x03org\x00"), records[0].Name)
+	assert.False(t, zone.names["host.example.org"])
+
+	assert.Equal(t, []RData{&RDataTXT{Texts: []string{"semi;colon", "a.b"}}}, testZoneRData(t, zone, "txt.example.org", TypeTXT))
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	soa := "@ 60 SOA ns hostmaster 1 2 3 4 5\n"
+	tests := []struct {
+		name  string
+		zone  string
+		error string
+	}{
+		{"no SOA", "www 60 A 192.0.2.1\n", "exactly one SOA got: 0"},
+		{"two SOAs", soa + soa, "exactly one SOA got: 2"},
+		{"outside of zone", soa + "www.example.net. 60 A 192.0.2.1\n", "outside of zone"},
+		{"no TTL", "@ SOA ns hostmaster 1 2 3 4 5\n", "line 1: record without TTL"},
+		{"no owner", " 60 A 192.0.2.1\n", "line 1: record without owner"},
+		{"unknown type", soa + "www 60 HINFO cpu os\n", `line 2: record type "HINFO" is not supported`},
+		{"bad address", soa + "www 60 A 2001:db8::1\n", "line 2: invalid IPv4 address"},
+		{"bad IPv6 address", soa + "www 60 AAAA 192.0.2.1\n", "line 2: invalid IPv6 address"},
+		{"values count", soa + "www 60 MX mail\n", "line 2: MX needs 2 values got: 1"},
+		{"bad number", soa + "www 60 MX 70000 mail\n", `line 2: invalid MX value "70000"`},
+		{"missing paren", "@ 60 SOA ns hostmaster ( 1 2\n3 4 5\n", "line 1: missing )"},
+		{"extra paren", soa + "www 60 A 192.0.2.1 )\n", "line 2: unexpected )"},
+		{"open quote", soa + "txt 60 TXT \"open\n", "line 2: quoted string not closed"},
+		{"include", "$INCLUDE other.zone\n", "line 1: $INCLUDE is not supported"},
+		{"relative origin", "$ORIGIN example.com\n", "line 1: $ORIGIN needs one absolute name"},
+		{"@ at the root", "$ORIGIN .\n" + soa, `line 2: relative name "@" without $ORIGIN`},
+		{"empty label", soa + "a..b 60 A 192.0.2.1\n", "line 2: invalid name"},
+		{"CNAME and other data", soa + "www 60 CNAME a\nwww 60 A 192.0.2.1\n", "www.example.com has CNAME and other records"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseZone(strings.NewReader(test.zone), "example.com")
+			assert.ErrorContains(t, err, test.error)
+		})
+	}
+
+	_, err := ParseZone(strings.NewReader("www 60 A 192.0.2.1\n"), "")
+	assert.ErrorContains(t, err, `line 1: relative name "www" without $ORIGIN`)
+
+	// LoadZoneFile parses without origin so the file has to set it before using @
+	_, err = ParseZone(strings.NewReader("@ 3600 IN SOA ns1.example.com. host.example.com. 1 2 3 4 5\n"), "")
+	assert.ErrorContains(t, err, `line 1: relative name "@" without $ORIGIN`)
+}
+
+func TestParseZoneTTL(t *testing.T) {
+	tests := map[string]uint32{
+		"0":        0,
+		"300":      300,
+		"5m":       300,
+		"1H":       3600,
+		"1h30m":    5400,
+		"1w2d3h4m": 7*86400 + 2*86400 + 3*3600 + 4*60,
+	}
+	for text, expected := range tests {
+		ttl, err := parseZoneTTL(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, ttl, text)
+	}
+
+	for _, text := range []string{"", "h", "1x", "1h30", "4294967296", "8000w"} {
+		_, err := parseZoneTTL(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestLoadZoneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	assert.NoError(t, os.WriteFile(path, []byte(testZone), 0o600))
+
+	zone, err := LoadZoneFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", zone.Origin())
+
+	assert.NoError(t, os.WriteFile(path, []byte("www 60 A 192.0.2.1\n"), 0o600))
+	_, err = LoadZoneFile(path)
+	assert.ErrorContains(t, err, path+": line 1")
+
+	_, err = LoadZoneFile(filepath.Join(t.TempDir(), "missing.zone"))
+	assert.ErrorContains(t, err, "failed to open zone file")
+}